@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// Status boards are messages kept up to date with server status and online
+// players, e.g. in the community group and an admin channel. Each board has
+// its own template. Boards are kept in state.json
+
+const (
+	BoardUpdateDelay     = time.Second * 2  // Changes within it go in one edit
+	BoardMinInterval     = time.Second * 3  // Telegram allows about 20 edits per minute in groups
+	BoardRetryInterval   = time.Second * 15 // After network errors
+	BoardRefreshInterval = time.Minute      // Durations on boards change even without events
+	DefaultBoardTemplate = "default"
+)
+
+// Built-in templates, StatusTemplates in config can add more or replace them
+var boardTemplates = map[string]string{
+	"default": `{{if .Maintenance}}Maintenance{{else if not .Online}}Offline{{else if .Players}}Online: {{range $i, $p := .Players}}{{if $i}}, {{end}}{{$p.Nickname}}{{end}}{{else}}Online: 0{{end}}`,
+	"full": `{{if .Maintenance}}🔧 Maintenance{{with .MaintenanceReason}}: {{.}}{{end}}{{with .MaintenanceLeft}}, about {{duration .}} left{{end}}
+{{end}}{{if .Online}}🟢 Online: {{len .Players}}, uptime {{duration .Uptime}}
+{{range .Players}}• {{.Nickname}} - {{duration .Session}}
+{{end}}{{else}}🔴 Offline{{with .OfflineReason}}: {{.}}{{end}}{{with .Downtime}} for {{duration .}}{{end}}{{end}}`,
+}
+
+// StatusBoard is a message showing server status
+type StatusBoard struct {
+	ChatID    int64     `json:"chat_id"`
+	MessageID int64     `json:"message_id"`
+	Template  string    `json:"template"` // Name of template or template itself
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type boardPlayer struct {
+	Nickname string
+	Session  time.Duration // Since login
+}
+
+// boardData is what board templates are executed with
+type boardData struct {
+	Online        bool
+	Players       []boardPlayer // Sorted by nickname
+	Uptime        time.Duration // Since the server went online
+	Downtime      time.Duration // Since the server went offline, 0 if unknown
+	OfflineReason string
+	Maintenance   bool // Only admins may join
+	// Shown during maintenance
+	MaintenanceReason string
+	MaintenanceLeft   time.Duration // Until expected end, 0 if unknown
+}
+
+var (
+	boardFuncs = template.FuncMap{"duration": formatDuration}
+
+	// Tells the updater that boards are out of date
+	boardsDirty = make(chan struct{}, 1)
+	// Serializes edits, so the last one on shutdown isn't overwritten
+	boardsMu sync.Mutex
+)
+
+// formatDuration formats d as `2d 3h`, `1h 5m` or `7m`
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	switch {
+	case hours >= 24:
+		return fmt.Sprintf("%dd %dh", hours/24, hours%24)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// parseBoardTemplate returns template by name, or parses text if it isn't a name
+func parseBoardTemplate(nameOrText string) (*template.Template, error) {
+	text := nameOrText
+	if !strings.Contains(text, "{{") {
+		if text == "" {
+			text = DefaultBoardTemplate
+		}
+		named, ok := cfg.StatusTemplates[text]
+		if !ok {
+			named, ok = boardTemplates[text]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown template `%s`", text)
+		}
+		text = named
+	}
+	return template.New("board").Funcs(boardFuncs).Parse(text)
+}
+
+func currentBoardData() boardData {
+	serverStatus.RLock()
+	data := boardData{
+		Online:        serverStatus.isOnline && !shutdown,
+		OfflineReason: serverStatus.offlineReason,
+	}
+	since := serverStatus.since
+	serverStatus.RUnlock()
+
+	now := time.Now()
+	if m := appState.Maintenance(); m != nil {
+		data.Maintenance = true
+		data.MaintenanceReason = m.Reason
+		if !m.Until.IsZero() {
+			data.MaintenanceLeft = max(0, m.Until.Sub(now))
+		}
+	}
+	switch {
+	case shutdown:
+		data.OfflineReason = ReasonProxyStopped
+	case data.Online:
+		data.Uptime = now.Sub(since)
+		data.OfflineReason = ""
+	case !since.IsZero():
+		data.Downtime = now.Sub(since)
+	}
+	if !data.Online {
+		return data
+	}
+
+	for nickname, login := range getOnlinePlayers() {
+		data.Players = append(data.Players, boardPlayer{Nickname: nickname, Session: now.Sub(login)})
+	}
+	// Same players give the same text, so it isn't edited again
+	sort.Slice(data.Players, func(i, j int) bool { return data.Players[i].Nickname < data.Players[j].Nickname })
+	return data
+}
+
+// renderBoard executes template of board with data
+func renderBoard(board StatusBoard, data boardData) (string, error) {
+	tmpl, err := parseBoardTemplate(board.Template)
+	if err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	if err := tmpl.Execute(&text, data); err != nil {
+		return "", err
+	}
+	// Telegram doesn't accept empty messages
+	if strings.TrimSpace(text.String()) == "" {
+		return ".", nil
+	}
+	return text.String(), nil
+}
+
+// updateStatusBoards schedules update of all boards, it never blocks
+func updateStatusBoards() {
+	select {
+	case boardsDirty <- struct{}{}:
+	default:
+	}
+}
+
+// startBoardUpdater edits boards after changes and once in a while. Bursts of
+// joins and leaves become one edit, and Telegram flood limits are waited out,
+// so boards always end up showing the latest state
+func startBoardUpdater() {
+	ticker := time.NewTicker(BoardRefreshInterval)
+	defer ticker.Stop()
+
+	shown := make(map[string]string)
+	lastEdit := time.Time{}
+	for {
+		select {
+		case <-boardsDirty:
+			time.Sleep(max(BoardUpdateDelay, BoardMinInterval-time.Since(lastEdit)))
+		case <-ticker.C:
+		}
+		for !shutdown {
+			wait := editBoards(shown)
+			lastEdit = time.Now()
+			if wait == 0 {
+				break
+			}
+			time.Sleep(wait)
+		}
+	}
+}
+
+// editBoards shows the current state on every board, unless shown already has it
+// for the board. Returns how long to wait before retrying, 0 if there is nothing to retry
+func editBoards(shown map[string]string) time.Duration {
+	boardsMu.Lock()
+	defer boardsMu.Unlock()
+
+	b := currentBot()
+	if b == nil {
+		return 0
+	}
+
+	data := currentBoardData()
+	var wait time.Duration
+	for _, board := range appState.Boards() {
+		key := fmt.Sprintf("%d/%d", board.ChatID, board.MessageID)
+		text, err := renderBoard(board, data)
+		if err != nil {
+			text = "Template error: " + err.Error()
+		}
+		if shown[key] == text {
+			continue
+		}
+
+		_, _, err = b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+			ChatId:    board.ChatID,
+			MessageId: board.MessageID,
+		})
+		var tgErr *gotgbot.TelegramError
+		switch {
+		case err == nil || strings.Contains(err.Error(), "Bad Request: message is not modified"):
+			shown[key] = text
+		case errors.As(err, &tgErr) && tgErr.ResponseParams != nil && tgErr.ResponseParams.RetryAfter > 0:
+			retry := time.Duration(tgErr.ResponseParams.RetryAfter) * time.Second
+			log.Printf("Status board in %d is rate limited, retrying in %v\n", board.ChatID, retry)
+			wait = max(wait, retry)
+		case errors.As(err, &tgErr) && strings.Contains(err.Error(), "message to edit not found"):
+			log.Printf("Status board in %d was deleted, forgetting it\n", board.ChatID)
+			appState.RemoveBoard(board.ChatID)
+		case errors.As(err, &tgErr):
+			// Retrying won't help until the text changes
+			log.Printf("Failed to update status board in %d: %v", board.ChatID, err)
+			shown[key] = text
+		default:
+			log.Printf("Failed to update status board in %d, retrying in %v: %v", board.ChatID, BoardRetryInterval, err)
+			wait = max(wait, BoardRetryInterval)
+		}
+	}
+	return wait
+}
+
+// handleOnlineCommand creates status board in the chat, replacing the previous one there:
+//
+//	/online [template name]
+//	/online
+//	<template text>
+//	/online off
+func handleOnlineCommand(b *gotgbot.Bot, ctx *ext.Context, args string) error {
+	args = strings.TrimSpace(args)
+	chatID := ctx.EffectiveChat.Id
+
+	if args == "off" {
+		board, err := appState.RemoveBoard(chatID)
+		if err != nil {
+			return err
+		}
+		if board != nil {
+			b.DeleteMessage(board.ChatID, board.MessageID, nil)
+		}
+		_, err = ctx.EffectiveMessage.SetReaction(b, &gotgbot.SetMessageReactionOpts{
+			Reaction: []gotgbot.ReactionType{gotgbot.ReactionTypeEmoji{Emoji: "👌"}},
+		})
+		return err
+	}
+
+	board := StatusBoard{
+		ChatID:    chatID,
+		Template:  args,
+		CreatedBy: ctx.EffectiveSender.Id(),
+		CreatedAt: time.Now(),
+	}
+	text, err := renderBoard(board, currentBoardData())
+	if err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, "Template error: "+err.Error(), nil)
+		return err
+	}
+	sent, err := ctx.EffectiveMessage.Reply(b, text, nil)
+	if err != nil {
+		return err
+	}
+
+	board.MessageID = sent.MessageId
+	old, err := appState.SetBoard(board)
+	if err != nil {
+		b.DeleteMessage(sent.Chat.Id, sent.MessageId, nil)
+		return err
+	}
+	if old != nil {
+		b.DeleteMessage(old.ChatID, old.MessageID, nil)
+	}
+	return nil
+}
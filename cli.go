@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `Usage:
+  MCAuthProxy [config]                        run the proxy
+  MCAuthProxy [-c config] <command> ...       manage records offline
+
+Commands:
+  users list                                  show all registered nicknames
+  users add <nickname> <tgid> [name]          register nickname, prints its address
+  users delete <nickname>                     delete nickname of any owner
+  users rotate <nickname> [key id]            replace token of a key (first key by default)
+  export [--json] [file]                      write records as TSV or JSON, stdout by default
+  import [--replace] <file|->                 add records from TSV or JSON export or backup
+
+Stop the proxy before changing records, it doesn't reload files`
+
+// isCLICommand reports whether arg starts a management command instead of config path
+func isCLICommand(arg string) bool {
+	switch arg {
+	case "users", "export", "import", "help", "-h", "--help":
+		return true
+	}
+	return false
+}
+
+// runCLI executes a management command on already opened storage
+func runCLI(args []string) error {
+	switch args[0] {
+	case "users":
+		if len(args) < 2 {
+			return errors.New(cliUsage)
+		}
+		switch args[1] {
+		case "list":
+			return cliListUsers()
+		case "add":
+			return cliAddUser(args[2:])
+		case "delete":
+			return cliDeleteUser(args[2:])
+		case "rotate":
+			return cliRotateUser(args[2:])
+		}
+	case "export":
+		return cliExport(args[1:])
+	case "import":
+		return cliImport(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(cliUsage)
+		return nil
+	}
+	return errors.New(cliUsage)
+}
+
+func cliListUsers() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NICKNAME\tTGID\tNAME\tKEYS\tCREATED\tLAST SEEN\tFLAGS")
+	storage.ForEach(func(r StorageRecord) bool {
+		var flags []string
+		if r.Disabled {
+			flags = append(flags, "disabled")
+		}
+		if r.Guest {
+			flags = append(flags, "guest")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t%s\n", r.Nickname, r.ID, r.TgName, len(r.Keys),
+			formatCLITime(r.CreatedAt), formatCLITime(r.LastSeen), strings.Join(flags, ","))
+		return true
+	})
+	return w.Flush()
+}
+
+func formatCLITime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func cliAddUser(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: users add <nickname> <tgid> [name]")
+	}
+	nickname := args[0]
+	if !isValidMinecraftUsername(nickname) {
+		return fmt.Errorf("bad nickname `%s`", nickname)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad telegram ID `%s`", args[1])
+	}
+	name := strings.Join(args[2:], " ")
+
+	record, err := storage.AddRecord(nickname, name, id)
+	if err == ErrNicknameReserved {
+		// Command line is as trusted as the admin
+		if err = storage.ReleaseNickname(nickname); err == nil {
+			record, err = storage.AddRecord(nickname, name, id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tgUsers.Approve(id, 0); err != nil {
+		return err
+	}
+	fmt.Println(record.Keys[0].Token + "." + cfg.BaseDomain)
+	return nil
+}
+
+func cliDeleteUser(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: users delete <nickname>")
+	}
+	record, err := storage.FindByNickname(args[0])
+	if err != nil {
+		return err
+	}
+	return storage.DeleteByNickname(record.Nickname, record.ID)
+}
+
+func cliRotateUser(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: users rotate <nickname> [key id]")
+	}
+	record, err := storage.FindByNickname(args[0])
+	if err != nil {
+		return err
+	}
+	keyID := record.Keys[0].ID
+	if len(args) == 2 {
+		if keyID, err = strconv.Atoi(args[1]); err != nil {
+			return fmt.Errorf("bad key id `%s`", args[1])
+		}
+	}
+
+	_, key, err := storage.RotateToken(record.Nickname, record.ID, keyID)
+	if err != nil {
+		return err
+	}
+	fmt.Println(key.Token + "." + cfg.BaseDomain)
+	return nil
+}
+
+func cliExport(args []string) error {
+	asJSON := false
+	filename := ""
+	for _, arg := range args {
+		if arg == "--json" {
+			asJSON = true
+		} else {
+			filename = arg
+		}
+	}
+
+	state := storageState{KeyCheck: storage.KeyCheck()}
+	storage.ForEach(func(r StorageRecord) bool {
+		state.Records = append(state.Records, r)
+		return true
+	})
+
+	write := func(w io.Writer) error {
+		if !asJSON {
+			return writeTSV(w, state)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(jsonExport{KeyCheck: state.KeyCheck, Records: state.Records})
+	}
+	if filename == "" || filename == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := write(w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	return writeFileAtomic(filename, write)
+}
+
+// jsonExport is the JSON form of export, older versions wrote just the records array
+type jsonExport struct {
+	KeyCheck string          `json:"key_check"` // See Storage.KeyCheck
+	Records  []StorageRecord `json:"records"`
+}
+
+func cliImport(args []string) error {
+	replace := false
+	filename := ""
+	for _, arg := range args {
+		if arg == "--replace" {
+			replace = true
+		} else {
+			filename = arg
+		}
+	}
+	if filename == "" {
+		return errors.New("usage: import [--replace] <file|->")
+	}
+
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	var state storageState
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &state.Records)
+	} else if len(trimmed) > 0 && trimmed[0] == '{' {
+		var export jsonExport
+		err = json.Unmarshal(trimmed, &export)
+		state = storageState{Records: export.Records, KeyCheck: export.KeyCheck}
+	} else {
+		state, err = readTSV(bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	if state.Skipped > 0 {
+		return fmt.Errorf("%d lines can't be read, nothing was imported", state.Skipped)
+	}
+	records := state.Records
+
+	// Nothing is imported if any record is bad
+	for _, r := range records {
+		r = r.clone()
+		r.upgrade()
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("%s: %w", r.Nickname, err)
+		}
+	}
+	if state.hasHashes() {
+		if state.KeyCheck == "" {
+			fmt.Fprintln(os.Stderr, "Warning: file doesn't tell which token key its hashes were made with, "+
+				"its addresses work only if it is the current one")
+		} else if state.KeyCheck != storage.KeyCheck() {
+			return errors.New("file was saved with another token key, its addresses wouldn't work. Import it with that key as TokenKeyFile")
+		}
+	}
+
+	imported, skipped := 0, 0
+	owners := make(map[int64]string)
+	for _, r := range records {
+		err := storage.ImportRecord(r, replace)
+		if err == ErrNicknameExists {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.Nickname, err)
+		}
+		owners[r.ID] = r.TgName
+		imported++
+	}
+	// Owners of restored nicknames were approved before
+	if err := tgUsers.ImportApproved(owners); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d records, skipped %d existing\n", imported, skipped)
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Messages kept for each user until fetched
+	httpOutboxSize = 100
+
+	DefaultLocalAPISecretFile = "local_api.secret"
+	// Header with the secret, browsers can't add it to cross-site requests without asking
+	localAPISecretHeader = "X-API-Secret"
+)
+
+// httpFrontend is a local HTTP/JSON frontend for scripts and testing flows
+// without Telegram. It trusts the user ID in requests, so it only listens on
+// loopback and requires the secret. Messages for users wait in outbox until fetched
+type httpFrontend struct {
+	mu     sync.Mutex
+	outbox map[int64][]string
+	secret string
+}
+
+var (
+	localAPI = &httpFrontend{outbox: make(map[int64][]string)}
+
+	errNoID = errors.New("id is required")
+)
+
+// isLoopbackAddr reports whether addr like `127.0.0.1:25580` listens on loopback only
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loadAPISecret reads secret of the local API, creating a new one if file doesn't exist
+func loadAPISecret(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		secret := strings.TrimSpace(string(data))
+		if len(secret) < 16 {
+			return "", fmt.Errorf("local API secret in %s is too short", filename)
+		}
+		return secret, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(key)
+	if err := os.WriteFile(filename, []byte(secret+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Printf("Created local API secret in %s\n", filename)
+	return secret, nil
+}
+
+func (h *httpFrontend) Send(id int64, msg string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	messages := append(h.outbox[id], msg)
+	if len(messages) > httpOutboxSize {
+		messages = messages[len(messages)-httpOutboxSize:]
+	}
+	h.outbox[id] = messages
+	return nil
+}
+
+// httpRequest is the body of POST requests
+type httpRequest struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Nickname string `json:"nickname"`
+	UserID   int64  `json:"user_id"` // User to approve, deny or block
+	Uses     int    `json:"uses"`    // New invite limit
+	Code     string `json:"code"`    // Invite to redeem
+}
+
+type httpRecord struct {
+	Nickname string   `json:"nickname"`
+	Address  string   `json:"address,omitempty"` // Only right after registration
+	Keys     []string `json:"keys"`              // Labels
+}
+
+// startLocalAPI serves the HTTP frontend on cfg.LocalAPI. Every request must
+// have the secret in X-API-Secret header, POST bodies are application/json:
+//
+//	POST /api/register {id, name, nickname} -> {nickname, address}
+//	POST /api/approve  {id, user_id}        -> {}
+//	POST /api/deny     {id, user_id}        -> {}
+//	POST /api/block    {id, user_id}        -> {}
+//	POST /api/delete   {id, nickname}       -> {reserved_until}
+//	POST /api/invite   {id, uses}           -> {code, expires_at, max_uses, ...}
+//	POST /api/redeem   {id, name, code}     -> {}
+//	GET  /api/list?id=                      -> [{nickname, keys}]
+//	GET  /api/messages?id=                  -> [messages for the user]
+func startLocalAPI() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/register", localAPI.handleRegister)
+	mux.HandleFunc("POST /api/approve", localAPI.handleDecision(ApproveUser))
+	mux.HandleFunc("POST /api/deny", localAPI.handleDecision(DenyUser))
+	mux.HandleFunc("POST /api/block", localAPI.handleDecision(BlockUser))
+	mux.HandleFunc("POST /api/delete", localAPI.handleDelete)
+	mux.HandleFunc("POST /api/invite", localAPI.handleInvite)
+	mux.HandleFunc("POST /api/redeem", localAPI.handleRedeem)
+	mux.HandleFunc("GET /api/list", localAPI.handleList)
+	mux.HandleFunc("GET /api/messages", localAPI.handleMessages)
+
+	log.Printf("Local API listening on %s\n", cfg.LocalAPI)
+	if err := http.ListenAndServe(cfg.LocalAPI, localAPI.requireSecret(mux)); err != nil {
+		log.Printf("Local API stopped: %v\n", err)
+	}
+}
+
+// requireSecret lets in only requests with the secret, which a web page can't forge
+func (h *httpFrontend) requireSecret(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(localAPISecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(h.secret)) != 1 {
+			writeHTTPJSON(w, http.StatusUnauthorized, httpError{"bad or missing " + localAPISecretHeader})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sender returns user of request, who must be approved
+func (h *httpFrontend) sender(w http.ResponseWriter, id int64, name string) (Sender, bool) {
+	if u, known := tgUsers.Get(id); known && name == "" {
+		name = u.Name
+	}
+	user := Sender{ID: id, Name: name, Frontend: h}
+	if id == 0 {
+		writeHTTPError(w, errNoID)
+		return user, false
+	}
+	if !Authorize(user) {
+		if err := RequestApproval(user, ""); err != nil {
+			writeHTTPError(w, err)
+		} else {
+			writeHTTPError(w, ErrNotApproved)
+		}
+		return user, false
+	}
+	return user, true
+}
+
+func (h *httpFrontend) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req httpRequest
+	if !readHTTPRequest(w, r, &req) {
+		return
+	}
+	user, ok := h.sender(w, req.ID, req.Name)
+	if !ok {
+		return
+	}
+
+	record, err := RegisterNickname(user, req.Nickname)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeHTTPResult(w, httpRecord{
+		Nickname: record.Nickname,
+		Address:  record.Keys[0].Token + "." + cfg.BaseDomain,
+		Keys:     []string{record.Keys[0].Label},
+	})
+}
+
+// handleDecision calls approve, deny or block on request's user_id
+func (h *httpFrontend) handleDecision(decide func(admin Sender, id int64) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req httpRequest
+		if !readHTTPRequest(w, r, &req) {
+			return
+		}
+		user, ok := h.sender(w, req.ID, req.Name)
+		if !ok {
+			return
+		}
+
+		if err := decide(user, req.UserID); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeHTTPResult(w, struct{}{})
+	}
+}
+
+func (h *httpFrontend) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req httpRequest
+	if !readHTTPRequest(w, r, &req) {
+		return
+	}
+	user, ok := h.sender(w, req.ID, req.Name)
+	if !ok {
+		return
+	}
+
+	until, err := DeleteNickname(user, req.Nickname)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	result := struct {
+		ReservedUntil *time.Time `json:"reserved_until"` // null if nickname isn't reserved
+	}{}
+	if !until.IsZero() {
+		result.ReservedUntil = &until
+	}
+	writeHTTPResult(w, result)
+}
+
+func (h *httpFrontend) handleInvite(w http.ResponseWriter, r *http.Request) {
+	var req httpRequest
+	if !readHTTPRequest(w, r, &req) {
+		return
+	}
+	user, ok := h.sender(w, req.ID, req.Name)
+	if !ok {
+		return
+	}
+
+	inv, err := CreateInvite(user, req.Uses)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeHTTPResult(w, inv)
+}
+
+// handleRedeem approves user with invite, so it doesn't require approval itself
+func (h *httpFrontend) handleRedeem(w http.ResponseWriter, r *http.Request) {
+	var req httpRequest
+	if !readHTTPRequest(w, r, &req) {
+		return
+	}
+	if req.ID == 0 {
+		writeHTTPError(w, errNoID)
+		return
+	}
+
+	user := Sender{ID: req.ID, Name: req.Name, Frontend: h}
+	if err := RedeemInvite(user, req.Code); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeHTTPResult(w, struct{}{})
+}
+
+func (h *httpFrontend) handleList(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	user, ok := h.sender(w, id, "")
+	if !ok {
+		return
+	}
+
+	records, err := ListNicknames(user)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	result := make([]httpRecord, 0, len(records))
+	for _, record := range records {
+		item := httpRecord{Nickname: record.Nickname}
+		for _, key := range record.Keys {
+			item.Keys = append(item.Keys, key.Label)
+		}
+		result = append(result, item)
+	}
+	writeHTTPResult(w, result)
+}
+
+// handleMessages returns and forgets messages sent to user, approval isn't needed
+func (h *httpFrontend) handleMessages(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeHTTPError(w, errNoID)
+		return
+	}
+
+	h.mu.Lock()
+	messages := h.outbox[id]
+	delete(h.outbox, id)
+	h.mu.Unlock()
+
+	if messages == nil {
+		messages = []string{}
+	}
+	writeHTTPResult(w, messages)
+}
+
+func readHTTPRequest(w http.ResponseWriter, r *http.Request, req *httpRequest) bool {
+	// Forms and text/plain can be sent cross-site without preflight
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeHTTPJSON(w, http.StatusUnsupportedMediaType, httpError{"Content-Type must be application/json"})
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeHTTPJSON(w, http.StatusBadRequest, httpError{err.Error()})
+		return false
+	}
+	return true
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+func writeHTTPResult(w http.ResponseWriter, result any) {
+	writeHTTPJSON(w, http.StatusOK, result)
+}
+
+// writeHTTPError replies with status matching the error
+func writeHTTPError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrBadNickname, errNoID:
+		status = http.StatusBadRequest
+	case ErrNotApproved, ErrAdminOnly, ErrModeratorOnly, ErrAccessDenied, ErrUserDenied, ErrUserBlocked:
+		status = http.StatusForbidden
+	case ErrRateLimited:
+		status = http.StatusTooManyRequests
+	case ErrNicknameNotFound, ErrBadInvite:
+		status = http.StatusNotFound
+	case ErrNicknameExists, ErrNicknameReserved, ErrAlreadyApproved, ErrInviteQuota:
+		status = http.StatusConflict
+	}
+	writeHTTPJSON(w, status, httpError{err.Error()})
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
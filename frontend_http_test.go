@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalAPIRequiresSecretAndJSON(t *testing.T) {
+	h := &httpFrontend{outbox: make(map[int64][]string), secret: "0123456789abcdef"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/test", func(w http.ResponseWriter, r *http.Request) {
+		var req httpRequest
+		if readHTTPRequest(w, r, &req) {
+			writeHTTPResult(w, req.ID)
+		}
+	})
+	handler := h.requireSecret(mux)
+
+	tests := []struct {
+		name, secret, contentType string
+		status                    int
+	}{
+		{"no secret", "", "application/json", http.StatusUnauthorized},
+		{"bad secret", "0123456789abcdeX", "application/json", http.StatusUnauthorized},
+		{"cross-site text", "0123456789abcdef", "text/plain", http.StatusUnsupportedMediaType},
+		{"form", "0123456789abcdef", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"json", "0123456789abcdef", "application/json; charset=utf-8", http.StatusOK},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", "/api/test", strings.NewReader(`{"id": 1}`))
+		r.Header.Set("Content-Type", tc.contentType)
+		if tc.secret != "" {
+			r.Header.Set(localAPISecretHeader, tc.secret)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:25580": true,
+		"[::1]:25580":     true,
+		"localhost:25580": true,
+		":25580":          false,
+		"0.0.0.0:25580":   false,
+		"10.0.0.1:25580":  false,
+		"127.0.0.1":       false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("%s: %v, want %v", addr, got, want)
+		}
+	}
+}
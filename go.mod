@@ -5,5 +5,4 @@ go 1.23.0
 require (
 	github.com/BurntSushi/toml v1.4.0
 	github.com/PaulSonOfLars/gotgbot/v2 v2.0.0-rc.29
-	github.com/deckarep/golang-set/v2 v2.6.0
 )
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultGuestMaxDuration = time.Hour * 24
+	GuestSweepInterval      = time.Minute
+)
+
+var ErrBadGuestLimit = errors.New("bad guest pass limit")
+
+// parseGuestPass parses limits like `3h`, `2d` or `5x` (logins)
+func parseGuestPass(args []string) (GuestPass, error) {
+	var pass GuestPass
+	for _, arg := range args {
+		arg = strings.ToLower(arg)
+		if n, isUses := strings.CutSuffix(arg, "x"); isUses {
+			uses, err := strconv.Atoi(n)
+			if err != nil || uses <= 0 {
+				return pass, ErrBadGuestLimit
+			}
+			pass.MaxUses = uses
+			continue
+		}
+		if n, isDays := strings.CutSuffix(arg, "d"); isDays {
+			days, err := strconv.Atoi(n)
+			if err != nil || days <= 0 {
+				return pass, ErrBadGuestLimit
+			}
+			pass.Duration = time.Duration(days) * time.Hour * 24
+			continue
+		}
+		duration, err := time.ParseDuration(arg)
+		if err != nil || duration <= 0 {
+			return pass, ErrBadGuestLimit
+		}
+		pass.Duration = duration
+	}
+	return pass, nil
+}
+
+// countGuestPasses returns number of active guest passes issued by id
+func countGuestPasses(id int64) int {
+	now := time.Now()
+	count := 0
+	storage.ForEach(func(r StorageRecord) bool {
+		for _, key := range r.Keys {
+			if key.IssuedBy == id && key.IsGuest() && !key.Expired(now) {
+				count++
+			}
+		}
+		return true
+	})
+	return count
+}
+
+// describeGuestPass returns human readable limits of guest key
+func describeGuestPass(key *AccessKey) string {
+	var limits []string
+	if !key.ExpiresAt.IsZero() {
+		limits = append(limits, Msg(MsgGuestUntil, key.ExpiresAt.Format("2006-01-02 15:04")))
+	}
+	if key.MaxUses > 0 {
+		limits = append(limits, Msg(MsgGuestLogins, key.MaxUses-key.Uses))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// startGuestSweeper periodically removes expired guest passes from storage
+func startGuestSweeper() {
+	ticker := time.NewTicker(GuestSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if shutdown {
+			return
+		}
+		removed, err := storage.RemoveExpired(time.Now(), keyInUse)
+		if err != nil {
+			log.Printf("Failed to remove expired guest passes: %v\n", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d expired guest passes\n", removed)
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInvitesFile = "invites.json"
+	DefaultInviteTTL   = time.Hour * 24 * 7
+	inviteCodeLen      = 12
+)
+
+var (
+	ErrBadInvite   = errors.New("invite is unknown, expired or used up")
+	ErrInviteQuota = errors.New("too many active invites")
+)
+
+// Invite lets new users in without admin approval
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+	UsedBy    []int64   `json:"used_by"`
+}
+
+// Active reports whether invite can still be used
+func (inv *Invite) Active(now time.Time) bool {
+	return now.Before(inv.ExpiresAt) && len(inv.UsedBy) < inv.MaxUses
+}
+
+// InviteStore keeps invites in memory and saves them as a whole JSON file on every change
+type InviteStore struct {
+	filename string
+	mu       sync.Mutex
+	invites  map[string]*Invite
+}
+
+// NewInviteStore loads invites from file, missing file means no invites
+func NewInviteStore(filename string) (*InviteStore, error) {
+	store := &InviteStore{
+		filename: filename,
+		invites:  make(map[string]*Invite),
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Invite
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, inv := range list {
+		store.invites[inv.Code] = inv
+	}
+	return store, nil
+}
+
+// Create makes a new invite. Invites that can't be used anymore are dropped
+func (s *InviteStore) Create(by int64, maxUses int, ttl time.Duration) (Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for code, inv := range s.invites {
+		if !inv.Active(now) {
+			delete(s.invites, code)
+		}
+	}
+
+	code := generateToken()[:inviteCodeLen]
+	if _, exists := s.invites[code]; exists {
+		return Invite{}, errors.New("invite code collision, try again")
+	}
+	inv := &Invite{
+		Code:      code,
+		CreatedBy: by,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		MaxUses:   maxUses,
+	}
+	s.invites[code] = inv
+	if err := s.save(); err != nil {
+		delete(s.invites, code)
+		return Invite{}, err
+	}
+	return *inv, nil
+}
+
+// Use records that user id joined with invite code
+func (s *InviteStore) Use(code string, id int64) (Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invites[code]
+	if !ok || !inv.Active(time.Now()) {
+		return Invite{}, ErrBadInvite
+	}
+	inv.UsedBy = append(inv.UsedBy, id)
+	if err := s.save(); err != nil {
+		inv.UsedBy = inv.UsedBy[:len(inv.UsedBy)-1]
+		return Invite{}, err
+	}
+	return *inv, nil
+}
+
+// Unuse gives back the use of invite code by id, when joining failed after Use
+func (s *InviteStore) Unuse(code string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invites[code]
+	if !ok {
+		return nil
+	}
+	i := slices.Index(inv.UsedBy, id)
+	if i < 0 {
+		return nil
+	}
+	usedBy := inv.UsedBy
+	inv.UsedBy = slices.Delete(slices.Clone(usedBy), i, i+1)
+	if err := s.save(); err != nil {
+		inv.UsedBy = usedBy
+		return err
+	}
+	return nil
+}
+
+// CountActive returns number of usable invites created by id
+func (s *InviteStore) CountActive(by int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, inv := range s.invites {
+		if inv.CreatedBy == by && inv.Active(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// save writes all invites to file. Caller must hold lock
+func (s *InviteStore) save() error {
+	list := make([]*Invite, 0, len(s.invites))
+	for _, inv := range s.invites {
+		list = append(list, inv)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	return writeFileAtomic(s.filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	})
+}
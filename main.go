@@ -1,13 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -17,9 +21,37 @@ type Config struct {
 	MinecraftServer     string
 	BaseDomain          string
 	BotToken            string
-	AdminID             int64
-	OnlineMessageID     int64
-	OnlineMessageChatID int64
+	BotAPIURL           string  // Custom Bot API server, e.g. a local one for tests
+	WebhookListen       string  // Receive bot updates on this address instead of long polling, e.g. 127.0.0.1:8443
+	WebhookPath         string  // Path of webhook requests, "/telegram" by default
+	WebhookURL          string  // Public webhook URL set on Telegram, empty if it's set some other way
+	WebhookSecret       string  // Required for webhook, Telegram sends it in X-Telegram-Bot-Api-Secret-Token header
+	AutoApproveChats    []int64 // Members of these chats are approved without admin
+	ConcurrentLogins    string  // Second login with the same nickname: "allow" (default), "reject" or "replace". "reject" still replaces a session from the same IP, it's a reconnect
+	LocalAPI            string  // Address of local HTTP/JSON frontend, e.g. 127.0.0.1:25580. Trusts user IDs, loopback only
+	LocalAPISecretFile  string  // Secret required by local API, created if missing. local_api.secret by default
+	Storage             string  // "tsv" (default) or "journal"
+	StorageFile         string
+	TokenKeyFile        string             // Secret for token hashes, keep it out of data backups
+	GuestQuota          int                // Active guest passes per user, admin isn't limited
+	GuestMaxDuration    time.Duration      // Longest guest pass users can issue
+	NicknameCooldown    time.Duration      // Deleted nicknames stay reserved for previous owner, 0 disables
+	InviteQuota         int                // Active invites per user, admin isn't limited
+	InviteMaxUses       int                // Most users one invite of a player can let in
+	InviteTTL           time.Duration      // How long invites stay valid
+	AdminID             int64              // Deprecated, same as Admins = [AdminID]
+	Admins              []int64            // Full control
+	Moderators          []int64            // May approve, deny and block users, kick players
+	Notify              map[string][]int64 // Event type -> who gets notifications, see notifyEvents
+	OnlineMessageID     int64              // Deprecated, moved to state.json on first start
+	OnlineMessageChatID int64              // Deprecated, as OnlineMessageID
+	StatusTemplates     map[string]string  // Status board templates by name, see boardTemplates
+	SilentDrop          bool               // Close logins with unknown, suspended or expired addresses without telling why
+	OfflineMOTD         string             // Server list text while the server is offline: plain text or JSON chat component
+	OfflineFavicon      string             // 64x64 PNG file shown in the server list while the server is offline
+	OfflineVersion      string             // Version name in the server list while the server is offline
+	OfflineMaxPlayers   int                // Max players in the server list while the server is offline
+	RestartDuration     time.Duration      // Usual restart time, the offline MOTD shows when the server is expected back
 	SupportName         string
 	Lang                string
 	DisableUDP          bool
@@ -27,29 +59,27 @@ type Config struct {
 }
 
 var (
-	storage    *Storage
+	storage    RecordStore
+	tgUsers    *UserStore
+	invites    *InviteStore
+	appState   *StateStore
 	cfg        Config
 	configFile string
 	shutdown   bool
 )
 
-func SaveConfig(config Config) {
-	file, err := os.Create(configFile)
-	if err != nil {
-		log.Printf("failed to create config file: %s", err)
-		return
-	}
-	defer file.Close()
-
-	encoder := toml.NewEncoder(file)
-	if err := encoder.Encode(config); err != nil {
-		log.Printf("failed to encode config: %s", err)
-		return
-	}
-}
+// Bot commands that can't be nicknames, since `/<nickname>` deletes it.
+// Longer nicknames are fine, commands with arguments are matched by the whole word
+var reservedCommands = []string{"online", "list", "delete", "regen", "addkey", "revoke", "guest", "pending", "invite", "start", "find", "transfer", "sessions", "kick", "maintenance"}
 
 func isValidMinecraftUsername(username string) bool {
-	if username == "online" || username == "list" || username == "delete" {
+	lower := strings.ToLower(username)
+	for _, command := range reservedCommands {
+		if lower == command || strings.HasPrefix(lower, command+"_") {
+			return false
+		}
+	}
+	if approveCommandRe.MatchString("/" + lower) {
 		return false
 	}
 	if len(username) < 3 || len(username) > 16 {
@@ -59,7 +89,16 @@ func isValidMinecraftUsername(username string) bool {
 	return match
 }
 
-func getUserInfoByHostname(host string) *StorageRecord {
+// Why server address doesn't let in, see disconnectReason
+var (
+	ErrWrongDomain    = errors.New("address is not under BaseDomain")
+	ErrUnknownAddress = errors.New("unknown address")
+	ErrSuspended      = errors.New("nickname is suspended")
+	ErrPassExpired    = errors.New("guest pass expired")
+)
+
+// getUserInfoByHostname returns record and the access key used in server address
+func getUserInfoByHostname(host string) (*StorageRecord, *AccessKey, error) {
 	// Remove port if present
 	parts := strings.SplitN(host, ":", 2)
 	host = parts[0]
@@ -70,24 +109,61 @@ func getUserInfoByHostname(host string) *StorageRecord {
 		if cfg.Verbose {
 			log.Printf("Someone tried to connect using address: %s\n", host)
 		}
-		return nil
+		return nil, nil, ErrWrongDomain
 	}
 
 	// Check token
-	userInfo, err := storage.FindByToken(token)
+	userInfo, key, err := storage.FindByToken(token)
 	if err != nil {
 		log.Printf("Someone tried to connect using bad token: %s\n", host)
-		return nil
+		return nil, nil, ErrUnknownAddress
+	}
+	if userInfo.Disabled {
+		log.Printf("Suspended nickname %s (%s) tried to connect\n", userInfo.Nickname, userInfo.TgName)
+		return nil, nil, ErrSuspended
 	}
-	return userInfo
+	if key.Expired(time.Now()) {
+		log.Printf("Expired guest pass of %s tried to connect\n", userInfo.Nickname)
+		return nil, nil, ErrPassExpired
+	}
+	return userInfo, key, nil
 }
 
-func main() {
-	configFile = "./config.toml"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+// openUserStore loads telegram users table. On first start everyone who
+// already has a registered nickname is approved, as before the table existed
+func openUserStore(filename string) (*UserStore, error) {
+	store, created, err := NewUserStore(filename)
+	if err != nil || !created {
+		return store, err
+	}
+
+	owners := make(map[int64]string)
+	storage.ForEach(func(userInfo StorageRecord) bool {
+		owners[userInfo.ID] = userInfo.TgName
+		return true
+	})
+	return store, store.ImportApproved(owners)
+}
+
+// openStateStore loads runtime state. On first start status board from
+// OnlineMessageID of older configs is moved there
+func openStateStore(filename string) (*StateStore, error) {
+	store, created, err := NewStateStore(filename)
+	if err != nil || !created || cfg.OnlineMessageID == 0 {
+		return store, err
 	}
-	_, err := toml.DecodeFile(configFile, &cfg)
+
+	_, err = store.SetBoard(StatusBoard{
+		ChatID:    cfg.OnlineMessageChatID,
+		MessageID: cfg.OnlineMessageID,
+		Template:  DefaultBoardTemplate,
+	})
+	return store, err
+}
+
+// loadConfig reads configFile into cfg and fills in defaults
+func loadConfig() {
+	meta, err := toml.DecodeFile(configFile, &cfg)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			log.Fatalf("Configuration file `%s` not found", configFile)
@@ -103,40 +179,148 @@ func main() {
 	if !strings.Contains(cfg.MinecraftServer, ":") {
 		cfg.MinecraftServer = "127.0.0.1:" + cfg.MinecraftServer
 	}
-
-	storage = NewStorage("data.txt")
-	go startMinecraftProxy()
-	if !cfg.DisableUDP {
-		go startUdpProxy(cfg.Listen, cfg.MinecraftServer)
+	if !meta.IsDefined("GuestQuota") {
+		cfg.GuestQuota = 1
+	}
+	if cfg.GuestMaxDuration <= 0 {
+		cfg.GuestMaxDuration = DefaultGuestMaxDuration
+	}
+	if !meta.IsDefined("NicknameCooldown") {
+		cfg.NicknameCooldown = DefaultNicknameCooldown
+	}
+	if !meta.IsDefined("InviteQuota") {
+		cfg.InviteQuota = 3
+	}
+	if cfg.InviteMaxUses <= 0 {
+		cfg.InviteMaxUses = 1
+	}
+	if cfg.InviteTTL <= 0 {
+		cfg.InviteTTL = DefaultInviteTTL
+	}
+	if cfg.AdminID != 0 && !slices.Contains(cfg.Admins, cfg.AdminID) {
+		cfg.Admins = append(cfg.Admins, cfg.AdminID)
+	}
+	if cfg.WebhookListen != "" {
+		if !webhookSecretRe.MatchString(cfg.WebhookSecret) {
+			log.Fatal("WebhookSecret is required for webhook: 1-256 characters A-Z, a-z, 0-9, _ and -")
+		}
+		if cfg.WebhookPath == "" {
+			cfg.WebhookPath = DefaultWebhookPath
+		}
+	}
+	if cfg.LocalAPI != "" {
+		if !isLoopbackAddr(cfg.LocalAPI) {
+			log.Fatalf("LocalAPI `%s` must be a loopback address like 127.0.0.1:25580, it trusts user IDs", cfg.LocalAPI)
+		}
+		if cfg.LocalAPISecretFile == "" {
+			cfg.LocalAPISecretFile = DefaultLocalAPISecretFile
+		}
+		localAPI.secret, err = loadAPISecret(cfg.LocalAPISecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if isJSONComponent(cfg.OfflineMOTD) && !json.Valid([]byte(cfg.OfflineMOTD)) {
+		log.Fatal("OfflineMOTD is not valid JSON")
+	}
+	if cfg.OfflineVersion == "" {
+		cfg.OfflineVersion = DefaultOfflineVersion
 	}
-	updater := startTgBot()
+	if cfg.OfflineFavicon != "" {
+		offlineFavicon, err = loadFavicon(cfg.OfflineFavicon)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch cfg.ConcurrentLogins {
+	case "":
+		cfg.ConcurrentLogins = LoginsAllow
+	case LoginsAllow, LoginsReject, LoginsReplace:
+	default:
+		log.Fatalf("Unknown ConcurrentLogins `%s`, expected %s, %s or %s", cfg.ConcurrentLogins, LoginsAllow, LoginsReject, LoginsReplace)
+	}
+	for event := range cfg.Notify {
+		if !slices.Contains(notifyEvents, event) {
+			log.Fatalf("Unknown event `%s` in Notify, expected one of: %s", event, strings.Join(notifyEvents, ", "))
+		}
+	}
+}
 
-	// Add telegram users to bot access
-	usersInfo, err := storage.readRecords()
+// openStores opens record storage and telegram users table
+func openStores() {
+	if cfg.TokenKeyFile == "" {
+		cfg.TokenKeyFile = DefaultTokenKeyFile
+	}
+	var err error
+	storage, err = OpenStorage(cfg.Storage, cfg.StorageFile, cfg.TokenKeyFile, cfg.NicknameCooldown)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tgUsers, err = openUserStore(DefaultUsersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	invites, err = NewInviteStore(DefaultInvitesFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, userInfo := range usersInfo {
-		allowedIDs.Add(int64(userInfo.ID))
+	appState, err = openStateStore(DefaultStateFile)
+	if err != nil {
+		log.Fatal(err)
 	}
-	// And admin too
-	allowedIDs.Add(cfg.AdminID)
+	storage.OnRevoke(kickRevoked)
+}
 
-	updateOnlineMessage()
+func main() {
+	// MCAuthProxy [-c config] <command> ... or MCAuthProxy [config]
+	configFile = "./config.toml"
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "-c" {
+		configFile = args[1]
+		args = args[2:]
+	}
+	if len(args) > 0 && isCLICommand(args[0]) {
+		loadConfig()
+		openStores()
+		if err := runCLI(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+	loadConfig()
+	openStores()
+
+	go startMinecraftProxy()
+	if !cfg.DisableUDP {
+		go startUdpProxy(cfg.Listen, cfg.MinecraftServer)
+	}
+	// Proxy keeps working while Telegram is disabled or unreachable
+	if cfg.BotToken != "" {
+		addFrontend(tgFrontend{})
+	}
+	if cfg.LocalAPI != "" {
+		addFrontend(localAPI)
+		go startLocalAPI()
+	}
+	go startTgBot()
 	go startServerStatusChecker()
+	go startBoardUpdater()
+	go startGuestSweeper()
+	if len(cfg.AutoApproveChats) > 0 {
+		go startMembershipSweeper()
+	}
 
 	// Handling Ctrl+C
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT)
-	go func() {
-		<-sigChan
-		log.Println("Shutdown signal received, setting server status to offline...")
-
-		shutdown = true // Prevent update in background
-		updateOnlineMessage()
+	<-sigChan
+	log.Println("Shutdown signal received, setting server status to offline...")
 
-		updater.Stop()
-		log.Println("Bot stopped.")
-	}()
-	updater.Idle()
+	shutdown = true // Prevent update in background
+	editBoards(make(map[string]string))
+	stopTgBot()
 }
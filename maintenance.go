@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// Maintenance mode keeps everyone except admins out of the server, e.g. during
+// upgrades. The server list shows it instead of asking the server
+
+var ErrBadMaintenanceEnd = errors.New("bad end time, expected duration like 2h or time like 18:30")
+
+// Maintenance is kept in state.json while it's on
+type Maintenance struct {
+	Reason    string    `json:"reason,omitempty"`
+	Until     time.Time `json:"until,omitempty"` // Expected end shown to players, zero if unknown
+	StartedBy int64     `json:"started_by"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// maintenanceAllows reports whether login with key of record is allowed during maintenance
+func maintenanceAllows(record *StorageRecord, key *AccessKey) bool {
+	return isAdmin(record.ID) && !record.Guest && !key.IsGuest()
+}
+
+// Describe returns text shown to players in the server list and on disconnect
+func (m Maintenance) Describe() string {
+	text := Msg(MsgDisconnectMaintenance)
+	if m.Reason != "" {
+		text += "\n" + m.Reason
+	}
+	if !m.Until.IsZero() && m.Until.After(time.Now()) {
+		text += "\n" + Msg(MsgMaintenanceUntil, formatClock(m.Until))
+	}
+	return text
+}
+
+// formatClock formats t as `18:30`, or with date if it isn't today
+func formatClock(t time.Time) string {
+	if y, m, d := t.Date(); y == time.Now().Year() && m == time.Now().Month() && d == time.Now().Day() {
+		return t.Format("15:04")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// parseMaintenanceEnd parses duration like `2h` or time of day like `18:30`, the nearest one
+func parseMaintenanceEnd(arg string) (time.Time, error) {
+	now := time.Now()
+	if duration, err := time.ParseDuration(arg); err == nil && duration > 0 {
+		return now.Add(duration), nil
+	}
+	clock, err := time.ParseInLocation("15:04", arg, time.Local)
+	if err != nil {
+		return time.Time{}, ErrBadMaintenanceEnd
+	}
+	until := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+	if until.Before(now) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, nil
+}
+
+// handleMaintenanceCommand turns maintenance mode on or off:
+//
+//	/maintenance on [2h or 18:30] [reason]
+//	/maintenance off
+func handleMaintenanceCommand(b *gotgbot.Bot, ctx *ext.Context, admin Sender, args string) error {
+	fields := strings.Fields(args)
+	var err error
+	switch {
+	case len(fields) == 1 && fields[0] == "off":
+		if err = StopMaintenance(admin); err == nil {
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgMaintenanceOff), nil)
+			return err
+		}
+	case len(fields) > 0 && fields[0] == "on":
+		fields = fields[1:]
+		var until time.Time
+		if len(fields) > 0 {
+			// End is optional, otherwise it is the first word of reason
+			if end, err := parseMaintenanceEnd(fields[0]); err == nil {
+				until = end
+				fields = fields[1:]
+			}
+		}
+		var kicked int
+		if kicked, err = StartMaintenance(admin, strings.Join(fields, " "), until); err == nil {
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgMaintenanceOn, kicked), nil)
+			return err
+		}
+	default:
+		msg := Msg(MsgMaintenanceUsage)
+		if m := appState.Maintenance(); m != nil {
+			msg = Msg(MsgMaintenanceActive, formatClock(m.StartedAt), m.Describe()) + "\n\n" + msg
+		}
+		_, err = ctx.EffectiveMessage.Reply(b, msg, nil)
+		return err
+	}
+	_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+	return err
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ const (
 
 	ServerBoundHandshakePacketID  byte = 0x00
 	ServerBoundLoginStartPacketID byte = 0x00
+	ClientBoundDisconnectPacketID byte = 0x00 // In login state
 
 	ForgeSeparator  = "\x00"
 	RealIPSeparator = "///"
@@ -265,11 +267,25 @@ func DecodeServerBoundLoginStart764(packet Packet) (ServerLoginStart764, error)
 
 ///////////////////////////////////////////////////////////////////////////////
 
+// ClientLoginDisconnect closes connection during login, the client shows the reason
+type ClientLoginDisconnect struct {
+	Reason McChat // JSON text component
+}
+
+func (pk ClientLoginDisconnect) ToPacket() *Packet {
+	var packet = &Packet{}
+	packet.ID = ClientBoundDisconnectPacketID
+	packet.Data = pk.Reason.Encode()
+	return packet
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
 type StatusJSON struct {
-	Version StatusVersionJSON `json:"version"`
-	// Players     PlaydersJSON     `json:"players"`
-	Description StatusDescriptionJSON `json:"description"`
-	Favicon     string                `json:"favicon"`
+	Version     StatusVersionJSON `json:"version"`
+	Players     StatusPlayersJSON `json:"players"`
+	Description json.RawMessage   `json:"description"` // Chat component
+	Favicon     string            `json:"favicon,omitempty"`
 }
 
 type StatusVersionJSON struct {
@@ -277,6 +293,11 @@ type StatusVersionJSON struct {
 	Protocol int    `json:"protocol"`
 }
 
+type StatusPlayersJSON struct {
+	Max    int `json:"max"`
+	Online int `json:"online"`
+}
+
 type StatusDescriptionJSON struct {
 	Text string `json:"text"`
 }
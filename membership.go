@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+const MembershipSweepInterval = time.Hour
+
+// findChatMembership returns one of AutoApproveChats the user is a member of, 0 if none.
+// Error means membership is unknown, e.g. Telegram is unreachable
+func findChatMembership(b *gotgbot.Bot, userID int64) (int64, error) {
+	var lastErr error
+	for _, chatID := range cfg.AutoApproveChats {
+		member, err := b.GetChatMember(chatID, userID, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch member.GetStatus() {
+		case "creator", "administrator", "member":
+			return chatID, nil
+		case "restricted":
+			if member.MergeChatMember().IsMember {
+				return chatID, nil
+			}
+		}
+	}
+	return 0, lastErr
+}
+
+// approveChatMember approves user who is a member of AutoApproveChats
+func approveChatMember(b *gotgbot.Bot, user Sender) bool {
+	if len(cfg.AutoApproveChats) == 0 {
+		return false
+	}
+	// They can't be approved this way, no need to ask Telegram
+	if u, known := tgUsers.Get(user.ID); known && (u.Status == UserBlocked || u.Status == UserDenied) {
+		return false
+	}
+	chatID, err := findChatMembership(b, user.ID)
+	if err != nil {
+		log.Printf("Failed to check chat membership of %d: %v\n", user.ID, err)
+	}
+	if chatID == 0 {
+		return false
+	}
+	if err := ApproveMember(user, chatID); err != nil {
+		if !errors.Is(err, ErrUserBlocked) && !errors.Is(err, ErrUserDenied) {
+			log.Printf("Failed to approve chat member %d: %v\n", user.ID, err)
+		}
+		return false
+	}
+	return true
+}
+
+// startMembershipSweeper periodically suspends users who left AutoApproveChats
+// and brings back the ones who returned
+func startMembershipSweeper() {
+	ticker := time.NewTicker(MembershipSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if shutdown {
+			return
+		}
+		if b := currentBot(); b != nil {
+			sweepMembers(b)
+		}
+
+		<-ticker.C
+	}
+}
+
+func sweepMembers(b *gotgbot.Bot) {
+	for _, user := range tgUsers.Members() {
+		if user.Status == UserBlocked || user.Status == UserDenied {
+			continue
+		}
+		chatID, err := findChatMembership(b, user.ID)
+		if err != nil && chatID == 0 {
+			// Don't suspend anyone only because Telegram failed to answer
+			log.Printf("Failed to check chat membership of %d: %v\n", user.ID, err)
+			continue
+		}
+
+		switch {
+		case chatID == 0 && user.Approved:
+			err = SuspendMember(user)
+		case chatID != 0 && !user.Approved:
+			err = ApproveMember(Sender{ID: user.ID, Name: user.Name, LangCode: user.LangCode}, chatID)
+		}
+		if err != nil {
+			log.Printf("Failed to update chat member %d: %v\n", user.ID, err)
+		}
+	}
+}
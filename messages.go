@@ -15,6 +15,8 @@ type MessageKey int
 const (
 	MsgRegistrationSuccess MessageKey = iota
 	MsgSelectNickToDelete
+	MsgDeleteFreesNickname
+	MsgDeleteReservesNickname
 	MsgNicknameDeleted
 	MsgDeleteError
 	MsgBadNickame
@@ -28,6 +30,77 @@ const (
 	MsgListCmd
 	MsgDeleteCmd
 	MsgOnlineCmd
+	MsgRegenCmd
+	MsgSelectNickToRegen
+	MsgTokenRegenerated
+	MsgAddKeyCmd
+	MsgAddKeyUsage
+	MsgKeyAdded
+	MsgKeyRevoked
+	MsgKeyNotFound
+	MsgLastKey
+	MsgTooManyKeys
+	MsgGuestRecordKey
+	MsgKeysTip
+	MsgNotYourNickname
+	MsgAddressesHidden
+	MsgGuestCmd
+	MsgGuestUsage
+	MsgGuestIssued
+	MsgGuestQuota
+	MsgGuestUntil
+	MsgGuestLogins
+	MsgNicknameReserved
+	MsgReservedUntil
+	MsgApprovalRequest
+	MsgApproveButton
+	MsgDenyButton
+	MsgBlockButton
+	MsgDenied
+	MsgBlocked
+	MsgUserApproved
+	MsgUserDenied
+	MsgUserBlocked
+	MsgNoPendingRequests
+	MsgInviteCmd
+	MsgInviteCreated
+	MsgInviteQuota
+	MsgBadInvite
+	MsgInviteAccepted
+	MsgAlreadyApproved
+	MsgFindUsage
+	MsgNothingFound
+	MsgFindHeader
+	MsgFindRecord
+	MsgFindTip
+	MsgConfirmDelete
+	MsgConfirmDeleteButton
+	MsgRecordDeleted
+	MsgTransferUsage
+	MsgTransferDone
+	MsgTransferUndelivered
+	MsgNicknameTransferred
+	MsgNoSessions
+	MsgSessionsHeader
+	MsgSession
+	MsgKickUsage
+	MsgKicked
+	MsgAlreadyPlaying
+	MsgConcurrentLoginRejected
+	MsgConcurrentLoginReplaced
+	MsgDisconnectUnknownAddress
+	MsgDisconnectSuspended
+	MsgDisconnectPassExpired
+	MsgDisconnectServerOffline
+	MsgDisconnectMaintenance
+	MsgDisconnectUnsupportedVersion
+	MsgMaintenanceUntil
+	MsgMaintenanceUsage
+	MsgMaintenanceActive
+	MsgMaintenanceOn
+	MsgMaintenanceOff
+	MsgStatusOffline
+	MsgRestartETA
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -51,16 +124,24 @@ var messages = map[MessageKey]Message{
 		ru: `⚠️ Важное предупреждение:
 			Удаление никнейма только освобождает его для регистрации другими игроками. Все данные персонажа на сервере (инвентарь, постройки, прогресс) останутся без изменений.
 
-			Если кто-то позже зарегистрирует этот никнейм, он получит доступ к вашему персонажу на сервере.
+			%s
 
 			🗑️ Выберите никнейм для удаления:`,
 		en: `⚠️ Important warning:
 			Deleting a nickname only makes it available for registration by other players. All character data on the server (inventory, buildings, progress) will remain unchanged.
 
-			If someone later registers this nickname, they will get access to your character on the server.
-			
+			%s
+
 			🗑️ Select nickname to delete:`,
 	},
+	MsgDeleteFreesNickname: {
+		ru: `Если кто-то позже зарегистрирует этот никнейм, он получит доступ к вашему персонажу на сервере.`,
+		en: `If someone later registers this nickname, they will get access to your character on the server.`,
+	},
+	MsgDeleteReservesNickname: {
+		ru: `Ещё %s никнейм будет зарезервирован за вами: зарегистрировать его снова сможете только вы или администратор. После этого любой, кто его зарегистрирует, получит доступ к вашему персонажу на сервере.`,
+		en: `For %s the nickname stays reserved for you: only you or an admin can register it again. After that, whoever registers it will get access to your character on the server.`,
+	},
 	MsgNicknameDeleted: {
 		ru: `✅ Никнейм освобождён`,
 		en: `✅ Nickname has been released`,
@@ -138,9 +219,373 @@ var messages = map[MessageKey]Message{
 		ru: `🗑️ Удалить один из ваших никнеймов`,
 		en: `🗑️ Delete one of your nicknames`,
 	},
+	MsgRegenCmd: {
+		ru: `🔑 Сменить адрес подключения, если он попал к посторонним`,
+		en: `🔑 Change connection address if it was leaked`,
+	},
+	MsgSelectNickToRegen: {
+		ru: `🔑 Для никнейма будет создан новый адрес подключения, старый сразу перестанет работать. Никнейм останется за вами.
+
+			Выберите никнейм:`,
+		en: `🔑 A new connection address will be created for the nickname, the old one stops working immediately. The nickname stays yours.
+
+			Select nickname:`,
+	},
+	MsgTokenRegenerated: {
+		ru: `✅ Адрес подключения для %s изменён. Старый адрес больше не работает.
+
+			Новый адрес:
+			` + "`%s`" + `
+
+			Замените адрес сервера в списке серверов Minecraft.`,
+		en: `✅ Connection address for %s has been changed. The old address no longer works.
+
+			New address:
+			` + "`%s`" + `
+
+			Replace the server address in your Minecraft server list.`,
+	},
+	MsgAddKeyCmd: {
+		ru: `➕ Создать отдельный адрес для ещё одного устройства`,
+		en: `➕ Create a separate address for another device`,
+	},
+	MsgAddKeyUsage: {
+		ru: `📝 Использование: /addkey <никнейм> <название>
+			Название устройства: до 16 символов, буквы (A-Z, a-z), цифры, _ и -
+			Например: /addkey Steve laptop`,
+		en: `📝 Usage: /addkey <nickname> <label>
+			Device label: up to 16 characters, letters (A-Z, a-z), numbers, _ and -
+			Example: /addkey Steve laptop`,
+	},
+	MsgKeyAdded: {
+		ru: `✅ Новый адрес «%s» для %s:
+			` + "`%s`" + `
+
+			Его можно отозвать отдельно, не затрагивая другие устройства.`,
+		en: `✅ New address "%s" for %s:
+			` + "`%s`" + `
+
+			It can be revoked on its own without affecting other devices.`,
+	},
+	MsgKeyRevoked: {
+		ru: `✅ Адрес отозван и больше не работает`,
+		en: `✅ Address revoked and no longer works`,
+	},
+	MsgKeyNotFound: {
+		ru: `⚠️ Такого адреса нет. Посмотрите актуальный список: /list`,
+		en: `⚠️ No such address. See the current list: /list`,
+	},
+	MsgLastKey: {
+		ru: `⚠️ Нельзя отозвать последний адрес никнейма
+			Используйте /regen, чтобы заменить его, или /delete, чтобы удалить никнейм.`,
+		en: `⚠️ Can't revoke the last address of a nickname
+			Use /regen to replace it, or /delete to remove the nickname.`,
+	},
+	MsgTooManyKeys: {
+		ru: `⚠️ У никнейма не может быть больше %d адресов`,
+		en: `⚠️ A nickname can't have more than %d addresses`,
+	},
+	MsgGuestRecordKey: {
+		ru: `⚠️ Это гостевой никнейм, ему можно выдать только гостевой пропуск: /guest`,
+		en: `⚠️ This is a guest nickname, it can only get guest passes: /guest`,
+	},
+	MsgKeysTip: {
+		ru: `💡 Отдельный адрес для другого устройства: /addkey <никнейм> <название>`,
+		en: `💡 Separate address for another device: /addkey <nickname> <label>`,
+	},
+	MsgAddressesHidden: {
+		ru: `🔒 Адреса хранятся в зашифрованном виде, поэтому бот показывает только их начало и не может прислать их повторно.
+			Потеряли адрес? Нажмите /regen рядом с ним, чтобы получить новый.`,
+		en: `🔒 Addresses are stored encrypted, so the bot only shows how they start and can't send them again.
+			Lost an address? Tap /regen next to it to get a new one.`,
+	},
+	MsgGuestCmd: {
+		ru: `🎟️ Выдать временный гостевой доступ`,
+		en: `🎟️ Issue a temporary guest pass`,
+	},
+	MsgGuestUsage: {
+		ru: `📝 Использование: /guest <никнейм> [срок] [Nx]
+			Срок: например 3h или 2d, не больше %v
+			Nx: число входов, например 5x
+
+			Если никнейм свободен, он будет создан для гостя и удалён после окончания доступа.
+			Если это ваш никнейм, гость будет играть за вашего персонажа.`,
+		en: `📝 Usage: /guest <nickname> [duration] [Nx]
+			Duration: e.g. 3h or 2d, at most %v
+			Nx: number of logins, e.g. 5x
+
+			If the nickname is free, it is created for the guest and removed when the pass ends.
+			If it's your nickname, the guest will play as your character.`,
+	},
+	MsgGuestIssued: {
+		ru: `🎟️ Гостевой доступ для %s:
+			` + "`%s`" + `
+
+			Действует: %s`,
+		en: `🎟️ Guest pass for %s:
+			` + "`%s`" + `
+
+			Valid: %s`,
+	},
+	MsgGuestQuota: {
+		ru: `⚠️ Можно иметь не больше %d активных гостевых доступов. Дождитесь окончания предыдущих.`,
+		en: `⚠️ You can have at most %d active guest passes. Wait for previous ones to expire.`,
+	},
+	MsgGuestUntil: {
+		ru: `до %s`,
+		en: `until %s`,
+	},
+	MsgGuestLogins: {
+		ru: `входов осталось: %d`,
+		en: `logins left: %d`,
+	},
+	MsgNicknameReserved: {
+		ru: `🔒 Этот никнейм недавно удалён и до %s зарезервирован за прежним владельцем
+			Пожалуйста, выберите другой никнейм.`,
+		en: `🔒 This nickname was deleted recently and is reserved for its previous owner until %s
+			Please choose a different nickname.`,
+	},
+	MsgApprovalRequest: {
+		ru: `👤 Заявка на регистрацию от %s (ID %d):`,
+		en: `👤 Registration request from %s (ID %d):`,
+	},
+	MsgApproveButton: {
+		ru: `✅ Одобрить`,
+		en: `✅ Approve`,
+	},
+	MsgDenyButton: {
+		ru: `❌ Отклонить`,
+		en: `❌ Deny`,
+	},
+	MsgBlockButton: {
+		ru: `⛔ Заблокировать`,
+		en: `⛔ Block`,
+	},
+	MsgDenied: {
+		ru: `❌ Ваша заявка на регистрацию отклонена администратором.`,
+		en: `❌ Your registration request has been denied by the administrator.`,
+	},
+	MsgBlocked: {
+		ru: `⛔ Администратор заблокировал вас, сообщения больше не принимаются.`,
+		en: `⛔ The administrator has blocked you, your messages are no longer accepted.`,
+	},
+	MsgUserApproved: {
+		ru: `✅ Одобрено`,
+		en: `✅ Approved`,
+	},
+	MsgUserDenied: {
+		ru: `❌ Отклонено`,
+		en: `❌ Denied`,
+	},
+	MsgUserBlocked: {
+		ru: `⛔ Заблокирован`,
+		en: `⛔ Blocked`,
+	},
+	MsgInviteCmd: {
+		ru: `Пригласить друга`,
+		en: `Invite a friend`,
+	},
+	MsgInviteCreated: {
+		ru: `🎟️ Ссылка-приглашение:
+			%s
+
+			Подходит для %d чел., действует до %s. Приглашённые сразу получат доступ к регистрации.`,
+		en: `🎟️ Invite link:
+			%s
+
+			Works for %d people until %s. Invited users can register right away.`,
+	},
+	MsgInviteQuota: {
+		ru: `⚠️ У вас уже %d действующих приглашений`,
+		en: `⚠️ You already have %d active invites`,
+	},
+	MsgBadInvite: {
+		ru: `⚠️ Приглашение не найдено, истекло или уже использовано`,
+		en: `⚠️ The invite is unknown, expired or already used`,
+	},
+	MsgInviteAccepted: {
+		ru: `✅ Приглашение принято!
+			Отправьте сообщение с желаемым никнеймом.`,
+		en: `✅ Invite accepted!
+			Please send a message with your desired nickname.`,
+	},
+	MsgAlreadyApproved: {
+		ru: `✅ У вас уже есть доступ. Отправьте никнейм, чтобы зарегистрировать его.`,
+		en: `✅ You already have access. Send a nickname to register it.`,
+	},
+	MsgNoPendingRequests: {
+		ru: `📭 Нет заявок на регистрацию`,
+		en: `📭 No pending registration requests`,
+	},
+	MsgReservedUntil: {
+		ru: `🔒 До %s удалённый никнейм сможете снова зарегистрировать только вы.`,
+		en: `🔒 Until %s only you will be able to register the deleted nickname again.`,
+	},
+	MsgNotYourNickname: {
+		ru: `⚠️ Этот никнейм зарегистрирован не вами`,
+		en: `⚠️ This nickname is not registered to you`,
+	},
 	MsgOnlineCmd: {
-		ru: `👥 [ADMIN] Автообновляемый список игроков онлайн`,
-		en: `👥 [ADMIN] Auto-updating online players list`,
+		ru: `👥 [ADMIN] Автообновляемый статус сервера в этом чате`,
+		en: `👥 [ADMIN] Auto-updating server status in this chat`,
+	},
+	MsgFindUsage: {
+		ru: `🔎 /find <никнейм, Telegram ID или имя> - поиск регистраций
+			Без запроса показывает все`,
+		en: `🔎 /find <nickname, Telegram ID or name> - search registrations
+			Without query shows all of them`,
+	},
+	MsgNothingFound: {
+		ru: `🔎 Ничего не найдено`,
+		en: `🔎 Nothing found`,
+	},
+	MsgFindHeader: {
+		ru: `🔎 Найдено: %d, страница %d из %d`,
+		en: `🔎 Found: %d, page %d of %d`,
+	},
+	MsgFindRecord: {
+		ru: `*%s*%s
+			Владелец: %s (ID %d)
+			Создан: %s, последний вход: %s, ключей: %d`,
+		en: `*%s*%s
+			Owner: %s (ID %d)
+			Created: %s, last login: %s, keys: %d`,
+	},
+	MsgFindTip: {
+		ru: `Передать никнейм: /transfer <никнейм> <Telegram ID>`,
+		en: `Transfer nickname: /transfer <nickname> <Telegram ID>`,
+	},
+	MsgConfirmDelete: {
+		ru: `⚠️ Удалить никнейм %s пользователя %s (ID %d)?
+			Его адреса перестанут работать.`,
+		en: `⚠️ Delete nickname %s of %s (ID %d)?
+			Its addresses will stop working.`,
+	},
+	MsgConfirmDeleteButton: {
+		ru: `🗑 Да, удалить`,
+		en: `🗑 Yes, delete`,
+	},
+	MsgRecordDeleted: {
+		ru: `🗑 Удалено`,
+		en: `🗑 Deleted`,
+	},
+	MsgTransferUsage: {
+		ru: `Использование: /transfer <никнейм> <Telegram ID нового владельца>
+			Все ключи никнейма заменяются, новый владелец получит новый адрес.`,
+		en: `Usage: /transfer <nickname> <new owner Telegram ID>
+			All keys of the nickname are replaced, the new owner gets a new address.`,
+	},
+	MsgTransferDone: {
+		ru: `✅ Никнейм %s передан, новый адрес отправлен владельцу`,
+		en: `✅ Nickname %s transferred, the new address was sent to the owner`,
+	},
+	MsgTransferUndelivered: {
+		ru: `⚠️ Никнейм %s передан, но не удалось написать владельцу. Передайте ему адрес:
+			%s`,
+		en: `⚠️ Nickname %s transferred, but the owner can't be reached. Pass them the address:
+			%s`,
+	},
+	MsgNicknameTransferred: {
+		ru: `🎁 Вам передан никнейм %s
+			Адрес сервера: %s`,
+		en: `🎁 Nickname %s was transferred to you
+			Server address: %s`,
+	},
+	MsgNoSessions: {
+		ru: `🎮 Сейчас никто не играет`,
+		en: `🎮 Nobody is playing now`,
+	},
+	MsgSessionsHeader: {
+		ru: `🎮 Сессий: %d`,
+		en: `🎮 Sessions: %d`,
+	},
+	MsgSession: {
+		ru: `*%s* - %s (ID %d), ключ %s
+			IP %s, протокол %d, %s, ↑%s ↓%s`,
+		en: `*%s* - %s (ID %d), key %s
+			IP %s, protocol %d, %s, ↑%s ↓%s`,
+	},
+	MsgKickUsage: {
+		ru: `Использование: /kick <никнейм>`,
+		en: `Usage: /kick <nickname>`,
+	},
+	MsgKicked: {
+		ru: `👢 %s отключён, сессий закрыто: %d`,
+		en: `👢 %s kicked, sessions closed: %d`,
+	},
+	MsgAlreadyPlaying: {
+		ru: `Этот никнейм уже играет с другого устройства`,
+		en: `This nickname is already playing from another device`,
+	},
+	MsgConcurrentLoginRejected: {
+		ru: `⚠️ Кто-то пытался зайти как %s с IP %s по адресу "%s", пока вы играли с IP %s. Вход отклонён.
+			Если это были не вы, смените адрес командой /regen`,
+		en: `⚠️ Someone tried to join as %s from IP %s with address "%s" while you were playing from IP %s. The login was refused.
+			If it wasn't you, change the address with /regen`,
+	},
+	MsgConcurrentLoginReplaced: {
+		ru: `⚠️ Кто-то зашёл как %s с IP %s по адресу "%s", ваше подключение с IP %s закрыто.
+			Если это были не вы, смените адрес командой /regen`,
+		en: `⚠️ Someone joined as %s from IP %s with address "%s", your connection from IP %s was closed.
+			If it wasn't you, change the address with /regen`,
+	},
+	MsgDisconnectUnknownAddress: {
+		ru: `Неизвестный адрес сервера.
+			Проверьте адрес или получите новый у бота командой /regen`,
+		en: `Unknown server address.
+			Check the address or get a new one from the bot with /regen`,
+	},
+	MsgDisconnectSuspended: {
+		ru: `Этот никнейм заблокирован администратором`,
+		en: `This nickname is suspended by admin`,
+	},
+	MsgDisconnectPassExpired: {
+		ru: `Гостевой пропуск истёк`,
+		en: `The guest pass has expired`,
+	},
+	MsgDisconnectServerOffline: {
+		ru: `Сервер сейчас не работает, попробуйте позже`,
+		en: `The server is offline now, try again later`,
+	},
+	MsgDisconnectMaintenance: {
+		ru: `Сервер на обслуживании`,
+		en: `The server is under maintenance`,
+	},
+	MsgDisconnectUnsupportedVersion: {
+		ru: `Эта версия Minecraft не поддерживается`,
+		en: `This Minecraft version is not supported`,
+	},
+	MsgMaintenanceUntil: {
+		ru: `Ожидаемое окончание: %s`,
+		en: `Expected to end at %s`,
+	},
+	MsgMaintenanceUsage: {
+		ru: `🔧 /maintenance on [2h или 18:30] [причина] - пускать на сервер только админов
+			/maintenance off - пускать всех`,
+		en: `🔧 /maintenance on [2h or 18:30] [reason] - let only admins join the server
+			/maintenance off - let everyone in`,
+	},
+	MsgMaintenanceActive: {
+		ru: `🔧 Обслуживание идёт с %s:
+			%s`,
+		en: `🔧 Maintenance since %s:
+			%s`,
+	},
+	MsgMaintenanceOn: {
+		ru: `🔧 Режим обслуживания включён, отключено игроков: %d`,
+		en: `🔧 Maintenance mode is on, players kicked: %d`,
+	},
+	MsgMaintenanceOff: {
+		ru: `✅ Режим обслуживания выключен`,
+		en: `✅ Maintenance mode is off`,
+	},
+	MsgStatusOffline: {
+		ru: `Сервер не работает`,
+		en: `Server is offline`,
+	},
+	MsgRestartETA: {
+		ru: `Ожидается к %s`,
+		en: `Expected back at %s`,
 	},
 }
 
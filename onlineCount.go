@@ -1,13 +1,13 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net"
-	"strings"
+	"os"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/PaulSonOfLars/gotgbot/v2"
 )
 
 const (
@@ -15,81 +15,37 @@ const (
 	OnlineCheckInterval  = time.Minute * 5 // Редкая проверка когда онлайн но пусто
 )
 
-var (
-	onlinePlayers = struct {
-		sync.RWMutex
-		players map[string]bool
-	}{
-		players: make(map[string]bool),
-	}
+// Why the server is offline, shown on status boards
+const (
+	ReasonNotRunning    = "server is not running"
+	ReasonNotResponding = "server doesn't respond"
+	ReasonUnreachable   = "server is unreachable"
+	ReasonProxyStopped  = "proxy is stopped"
+)
 
+var (
 	serverStatus struct {
 		sync.RWMutex
-		isOnline  bool
-		lastCheck time.Time
+		isOnline      bool
+		lastCheck     time.Time
+		since         time.Time // Last change of isOnline
+		offlineReason string
 	}
 )
 
-func addPlayer(nickname string) {
-	onlinePlayers.Lock()
-	onlinePlayers.players[nickname] = true
-	onlinePlayers.Unlock()
-}
-
-func removePlayer(nickname string) {
-	onlinePlayers.Lock()
-	delete(onlinePlayers.players, nickname)
-	if len(onlinePlayers.players) == 0 {
-		go updateServerStatus()
-	}
-	onlinePlayers.Unlock()
-}
-
-func getOnlinePlayers() []string {
-	onlinePlayers.RLock()
-	defer onlinePlayers.RUnlock()
-
-	players := make([]string, 0, len(onlinePlayers.players))
-	for player := range onlinePlayers.players {
-		players = append(players, player)
-	}
-	return players
-}
-
-///////////////////////////////////////////////////////////////////////////////
-
-func updateOnlineMessage() {
-	if cfg.OnlineMessageID == 0 {
-		return
-	}
+// getOnlinePlayers returns login time of every online player,
+// the earliest one if the nickname has several sessions
+func getOnlinePlayers() map[string]time.Time {
+	sessions.RLock()
+	defer sessions.RUnlock()
 
-	players := getOnlinePlayers()
-	var msg string
-
-	if len(players) == 0 {
-		msg = "Online: 0"
-	} else {
-		msg = "Online: "
-		for i, player := range players {
-			if i > 0 {
-				msg += ", "
-			}
-			msg += player
+	players := make(map[string]time.Time, len(sessions.byID))
+	for _, session := range sessions.byID {
+		if since, ok := players[session.Nickname]; !ok || session.StartedAt.Before(since) {
+			players[session.Nickname] = session.StartedAt
 		}
 	}
-
-	if !serverStatus.isOnline || shutdown {
-		msg = "Offline"
-	}
-
-	// TODO 20 msg per minute in groups?
-	_, _, err := bot.EditMessageText(msg, &gotgbot.EditMessageTextOpts{
-		ChatId:    cfg.OnlineMessageChatID,
-		MessageId: cfg.OnlineMessageID,
-	})
-	if err != nil && !strings.Contains(err.Error(), "Bad Request: message is not modified") {
-		log.Printf("Failed to update online message: %v", err)
-	}
+	return players
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -109,21 +65,47 @@ func updateServerStatus() {
 		currentStatus = true
 	}
 
+	// Notifications wait for Telegram, status readers like server list pings must not
 	serverStatus.Lock()
-	defer serverStatus.Unlock()
-
-	if serverStatus.isOnline != currentStatus {
+	reasonChanged := false
+	if reason := offlineReason(err); reason != serverStatus.offlineReason {
+		serverStatus.offlineReason = reason
+		reasonChanged = true
+	}
+	statusChanged := serverStatus.isOnline != currentStatus
+	if statusChanged {
 		serverStatus.isOnline = currentStatus
 		serverStatus.lastCheck = time.Now()
+		serverStatus.since = serverStatus.lastCheck
+	}
+	serverStatus.Unlock()
 
+	if statusChanged {
 		if currentStatus {
 			log.Println("Server is now ONLINE")
-			bot.SendMessage(cfg.AdminID, "🟢 Server is online.", nil)
+			notify(EventServer, "🟢 Server is online.")
 		} else {
 			log.Println("Server is now OFFLINE")
-			bot.SendMessage(cfg.AdminID, "🔴 Server is now OFFLINE!", nil)
+			notify(EventServer, "🔴 Server is now OFFLINE!")
 		}
-		updateOnlineMessage()
+	}
+	if reasonChanged || statusChanged {
+		updateStatusBoards()
+	}
+}
+
+// offlineReason explains dial error without internal addresses, empty if there is no error
+func offlineReason(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonNotRunning
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonNotResponding
+	default:
+		return ReasonUnreachable
 	}
 }
 
@@ -73,11 +73,17 @@ func handleConnection(clientConn net.Conn) {
 	}
 
 	// Check access
-	userInfo := getUserInfoByHostname(handshake.Address)
-	if userInfo == nil {
+	userInfo, key, err := getUserInfoByHostname(handshake.Address)
+	if err != nil {
 		if cfg.Verbose {
 			log.Println("Remote addr: ", clientConn.RemoteAddr().String())
 		}
+		// Addresses of other domains are scanners, they learn nothing
+		if handshake.NextState == HandshakeLogin && err != ErrWrongDomain && !cfg.SilentDrop {
+			ReadPacket(reader) // LoginStart, unread data would reset the connection
+			sendLoginDisconnect(clientConn, disconnectReason(err))
+			return
+		}
 		clientConn.Close()
 		return
 	}
@@ -86,9 +92,9 @@ func handleConnection(clientConn net.Conn) {
 	clientConn.SetDeadline(time.Time{})
 
 	if handshake.NextState == HandshakeStatus {
-		handleStatusRequest(clientConn, handshake)
+		handleStatusRequest(clientConn, reader, handshake)
 	} else if handshake.NextState == HandshakeLogin {
-		handleLoginRequest(clientConn, handshake, userInfo)
+		handleLoginRequest(clientConn, reader, handshake, userInfo, key)
 	} else {
 		if cfg.Verbose {
 			log.Printf("Unknown handshake.NextState: %v\n", handshake.NextState)
@@ -97,34 +103,52 @@ func handleConnection(clientConn net.Conn) {
 	}
 }
 
-func handleStatusRequest(clientConn net.Conn, handshake ServerBoundHandshake) {
-	err := ProxyConnection(clientConn, cfg.MinecraftServer, handshake.ToPacket().Encode())
+func handleStatusRequest(clientConn net.Conn, reader *bufio.Reader, handshake ServerBoundHandshake) {
+	if m := appState.Maintenance(); m != nil {
+		writeStatus(clientConn, reader, maintenanceStatus(m))
+		return
+	}
+
+	// Status request may be read into buffer together with handshake
+	buffered, _ := reader.Peek(reader.Buffered())
+	err := ProxyConnection(clientConn, cfg.MinecraftServer, append(handshake.ToPacket().Encode(), buffered...), nil)
 	if err != nil {
-		var packet Packet
-		packet.ID = 0
-		status := StatusJSON{
-			Version: StatusVersionJSON{
-				Name:     "Some server",
-				Protocol: int(handshake.ProtocolVersion),
-			},
-			Description: StatusDescriptionJSON{
-				Text: "Offline",
-			},
-		}
-		statusBytes, err := json.Marshal(status)
-		if err != nil {
-			clientConn.Close()
-			return
-		}
-		packet.Data = McString(statusBytes).Encode()
-		clientConn.Write(packet.Encode())
+		// Checker may not know yet, it rarely asks the server while it's online
+		go updateServerStatus()
+		writeStatus(clientConn, reader, offlineStatus(int(handshake.ProtocolVersion)))
+	}
+}
+
+// writeStatus answers status request and ping itself, without the server
+func writeStatus(clientConn net.Conn, reader *bufio.Reader, status StatusJSON) {
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(NetDeadline))
+
+	// Status request
+	if _, err := ReadPacket(reader); err != nil {
+		return
+	}
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	packet := Packet{ID: 0, Data: McString(statusBytes).Encode()}
+	if _, err := clientConn.Write(packet.Encode()); err != nil {
+		return
+	}
+
+	// Ping, pong is the same packet
+	ping, err := ReadPacket(reader)
+	if err != nil {
+		return
 	}
+	clientConn.Write(ping.Encode())
 }
 
-func handleLoginRequest(clientConn net.Conn, handshake ServerBoundHandshake, userInfo *StorageRecord) {
+func handleLoginRequest(clientConn net.Conn, reader *bufio.Reader, handshake ServerBoundHandshake, userInfo *StorageRecord, key *AccessKey) {
 	peekedData := handshake.ToPacket().Encode()
 
-	packet, err := ReadPacket(bufio.NewReader(clientConn))
+	packet, err := ReadPacket(reader)
 	if err != nil {
 		if cfg.Verbose {
 			log.Println("Error reading LoginStart:", err)
@@ -181,32 +205,89 @@ func handleLoginRequest(clientConn net.Conn, handshake ServerBoundHandshake, use
 	}
 
 	if err != nil {
-		log.Printf("error while parsing LoginStart: %v\n", err)
-		clientConn.Close()
+		log.Printf("error while parsing LoginStart of protocol %d: %v\n", handshake.ProtocolVersion, err)
+		sendLoginDisconnect(clientConn, Msg(MsgDisconnectUnsupportedVersion))
 		return
 	}
 
 	// Get client IP without the port
 	clientIP, _, _ := net.SplitHostPort(clientConn.RemoteAddr().String())
+
+	if m := appState.Maintenance(); m != nil && !maintenanceAllows(userInfo, key) {
+		log.Printf("Refused login of %s during maintenance\n", userInfo.Nickname)
+		sendLoginDisconnect(clientConn, m.Describe())
+		return
+	}
+
+	session, err := startSession(clientConn, userInfo, key, clientIP, int(handshake.ProtocolVersion))
+	if err != nil {
+		log.Printf("Rejected login of %s from %s: %v\n", userInfo.Nickname, clientIP, err)
+		sendLoginDisconnect(clientConn, Msg(MsgAlreadyPlaying))
+		return
+	}
+	defer endSession(session)
+	// Maintenance could start after the check above, but kick sessions before this one was registered
+	if m := appState.Maintenance(); m != nil && !session.Admin {
+		log.Printf("Refused login of %s during maintenance\n", userInfo.Nickname)
+		sendLoginDisconnect(clientConn, m.Describe())
+		return
+	}
+	// Access could be revoked while the login was read, before the session was registered
+	if current, currentKey, _ := getUserInfoByHostname(handshake.Address); current == nil || current.Nickname != userInfo.Nickname || current.ID != userInfo.ID || currentKey.ID != key.ID {
+		log.Printf("Access of %s was revoked during login\n", userInfo.Nickname)
+		return
+	}
+
 	// Authorize this IP for UDP traffic
 	AuthorizeUDP(clientIP)
 	// De-authorize the IP when the connection is closed
 	defer DeauthorizeUDP(clientIP)
 
-	addPlayer(userInfo.Nickname)
-	updateOnlineMessage()
-	log.Printf("User %s connected to %s from %s. Nickname %s -> %s\n", userInfo.TgName, cfg.BaseDomain, clientConn.RemoteAddr().String(), passedUsername, userInfo.Nickname)
+	err = storage.UpdateRecord(userInfo.Nickname, func(r *StorageRecord) error {
+		r.LastSeen = time.Now()
+		r.LastIP = clientIP
+		r.Sessions++
+		if usedKey, ok := r.Key(key.ID); ok {
+			usedKey.Uses++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save login of %s: %v\n", userInfo.Nickname, err)
+	}
+
+	log.Printf("User %s connected to %s from %s with key `%s`. Nickname %s -> %s\n", userInfo.TgName, cfg.BaseDomain, clientConn.RemoteAddr().String(), key.Label, passedUsername, userInfo.Nickname)
 
-	err = ProxyConnection(clientConn, cfg.MinecraftServer, peekedData)
+	err = ProxyConnection(clientConn, cfg.MinecraftServer, peekedData, session)
 	if err != nil {
+		// Nothing was sent to the client yet
 		log.Print(err)
+		sendLoginDisconnect(clientConn, Msg(MsgDisconnectServerOffline))
 	}
 
-	removePlayer(userInfo.Nickname)
-	updateOnlineMessage()
 	log.Printf("User %s disconnected. Nickname: %s\n", userInfo.TgName, userInfo.Nickname)
 }
 
+// disconnectReason explains to player why address from handshake doesn't work
+func disconnectReason(err error) string {
+	switch err {
+	case ErrSuspended:
+		return Msg(MsgDisconnectSuspended)
+	case ErrPassExpired:
+		return Msg(MsgDisconnectPassExpired)
+	default:
+		return Msg(MsgDisconnectUnknownAddress)
+	}
+}
+
+// sendLoginDisconnect shows reason to the client that is logging in and closes connection
+func sendLoginDisconnect(conn net.Conn, reason string) {
+	text, _ := json.Marshal(map[string]string{"text": reason})
+	conn.SetWriteDeadline(time.Now().Add(NetDeadline))
+	conn.Write(ClientLoginDisconnect{Reason: McChat(text)}.ToPacket().Encode())
+	conn.Close()
+}
+
 func handleResourcePackRequest(clientConn net.Conn, reader *bufio.Reader) {
 	// Read the HTTP request
 	request, err := http.ReadRequest(reader)
@@ -216,7 +297,7 @@ func handleResourcePackRequest(clientConn net.Conn, reader *bufio.Reader) {
 		return
 	}
 
-	userInfo := getUserInfoByHostname(request.Host)
+	userInfo, _, _ := getUserInfoByHostname(request.Host)
 	if userInfo == nil {
 		log.Printf("Reject HTTP request to: %s\n", request.URL.String())
 		clientConn.Close()
@@ -296,7 +377,9 @@ var bufferPool = sync.Pool{
 	},
 }
 
-func ProxyConnection(clientConn net.Conn, serverAddr string, peekedData []byte) (err error) {
+// ProxyConnection connects client to server. If session is given, it can close
+// both connections and counts traffic
+func ProxyConnection(clientConn net.Conn, serverAddr string, peekedData []byte, session *Session) (err error) {
 	dialer := net.Dialer{
 		Timeout: DialTimeout,
 		LocalAddr: &net.TCPAddr{
@@ -308,6 +391,15 @@ func ProxyConnection(clientConn net.Conn, serverAddr string, peekedData []byte)
 	if err != nil {
 		return err
 	}
+	var toServer, toClient io.Writer = serverConn, clientConn
+	if session != nil {
+		if !session.attachServer(serverConn) {
+			serverConn.Close()
+			return nil
+		}
+		toServer = countingWriter{serverConn, &session.BytesIn}
+		toClient = countingWriter{clientConn, &session.BytesOut}
+	}
 
 	_, err = serverConn.Write(peekedData)
 	if err != nil {
@@ -320,13 +412,13 @@ func ProxyConnection(clientConn net.Conn, serverAddr string, peekedData []byte)
 	go func() {
 		buffer := bufferPool.Get().([]byte)
 		defer bufferPool.Put(buffer)
-		io.CopyBuffer(serverConn, clientConn, buffer)
+		io.CopyBuffer(toServer, clientConn, buffer)
 		clientConn.Close()
 	}()
 
 	buffer := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buffer)
-	io.CopyBuffer(clientConn, serverConn, buffer)
+	io.CopyBuffer(toClient, serverConn, buffer)
 	serverConn.Close()
 
 	return nil
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registration logic shared by all frontends. Frontends parse commands,
+// call these functions as the user and present results in their own way
+
+var (
+	ErrNotApproved     = errors.New("user is not approved")
+	ErrAlreadyApproved = errors.New("user is already approved")
+	ErrBadNickname     = errors.New("bad nickname")
+	ErrAdminOnly       = errors.New("admin-only command")
+	ErrModeratorOnly   = errors.New("moderator-only command")
+	ErrFrontendOffline = errors.New("frontend is not connected")
+	ErrRateLimited     = errors.New("too many requests")
+	ErrUserDenied      = errors.New("user was denied")
+	ErrUserBlocked     = errors.New("user is blocked")
+	ErrNotOnline       = errors.New("player is not online")
+	ErrNoMaintenance   = errors.New("maintenance mode is off")
+)
+
+// Unapproved users get at most one reply per interval, other messages are ignored
+const UnapprovedReplyInterval = time.Minute
+
+// Notification events, Config.Notify subscribes users to them
+const (
+	EventRequests  = "requests"  // Approval requests
+	EventUsers     = "users"     // Users joined with invite or chat membership, left the chat
+	EventNicknames = "nicknames" // Nicknames registered or deleted, guest passes issued
+	EventServer    = "server"    // Minecraft server went online or offline
+	EventErrors    = "errors"    // Storage failures
+)
+
+var notifyEvents = []string{EventRequests, EventUsers, EventNicknames, EventServer, EventErrors}
+
+// Frontend is a way to reach users: Telegram bot, local HTTP API and so on
+type Frontend interface {
+	// Send delivers message to user, ErrFrontendOffline if it can't be done now
+	Send(id int64, msg string) error
+}
+
+// Sender is the user a request comes from
+type Sender struct {
+	ID       int64 // Telegram ID, other frontends use the same IDs
+	Name     string
+	LangCode string
+	Frontend Frontend // Where the request came from
+}
+
+func (s Sender) IsAdmin() bool {
+	return isAdmin(s.ID)
+}
+
+// IsModerator reports whether user may approve users and kick players. Admins are moderators too
+func (s Sender) IsModerator() bool {
+	return isModerator(s.ID)
+}
+
+func isAdmin(id int64) bool {
+	return slices.Contains(cfg.Admins, id)
+}
+
+func isModerator(id int64) bool {
+	return isAdmin(id) || slices.Contains(cfg.Moderators, id)
+}
+
+// approvalAsker is implemented by frontends that can show moderator
+// approve/deny/block buttons instead of a plain notification
+type approvalAsker interface {
+	AskApproval(to int64, user TgUser, note string) error
+}
+
+var (
+	// Registered on startup, before any requests
+	frontends []Frontend
+
+	// Last reply time for unapproved users
+	requestLimiter = struct {
+		sync.Mutex
+		last map[int64]time.Time
+	}{
+		last: make(map[int64]time.Time),
+	}
+)
+
+func addFrontend(f Frontend) {
+	frontends = append(frontends, f)
+}
+
+// subscribers returns users notified about event. Events missing in
+// Config.Notify go to admins, and ones about users go to moderators too
+func subscribers(event string) []int64 {
+	if ids, ok := cfg.Notify[event]; ok {
+		return ids
+	}
+	if event == EventRequests || event == EventUsers {
+		return append(slices.Clone(cfg.Admins), cfg.Moderators...)
+	}
+	return cfg.Admins
+}
+
+// notify sends message to subscribers of event through every connected frontend
+func notify(event string, msg string) {
+	for _, id := range subscribers(event) {
+		tellUser(id, msg)
+	}
+}
+
+// tellUser sends message to user through every connected frontend
+func tellUser(id int64, msg string) {
+	for _, f := range frontends {
+		if err := f.Send(id, msg); err != nil && err != ErrFrontendOffline {
+			log.Printf("Failed to send message to %d: %v\n", id, err)
+		}
+	}
+}
+
+// Authorize remembers user and reports whether they may use registration
+func Authorize(user Sender) bool {
+	if user.Name != "" {
+		tgUsers.Touch(user.ID, user.Name, user.LangCode)
+	}
+	return user.IsModerator() || tgUsers.IsApproved(user.ID)
+}
+
+// allowRequest reports whether unapproved user may be answered now
+func allowRequest(id int64) bool {
+	requestLimiter.Lock()
+	defer requestLimiter.Unlock()
+
+	now := time.Now()
+	if now.Sub(requestLimiter.last[id]) < UnapprovedReplyInterval {
+		return false
+	}
+	// Forget old entries from time to time, so spam from many accounts doesn't pile up
+	if len(requestLimiter.last) > 1000 {
+		for userID, t := range requestLimiter.last {
+			if now.Sub(t) >= UnapprovedReplyInterval {
+				delete(requestLimiter.last, userID)
+			}
+		}
+	}
+	requestLimiter.last[id] = now
+	return true
+}
+
+// RequestApproval puts user into pending queue. Moderators are asked only once,
+// note is what the user wrote. Returns ErrRateLimited, ErrUserDenied or
+// ErrUserBlocked when the user shouldn't get any reply
+func RequestApproval(user Sender, note string) error {
+	if !allowRequest(user.ID) {
+		return ErrRateLimited
+	}
+	return queueApproval(user, note)
+}
+
+// queueApproval is RequestApproval for callers that already checked allowRequest
+func queueApproval(user Sender, note string) error {
+	tgUser, isNew, err := tgUsers.Request(user.ID, user.Name, user.LangCode)
+	if err != nil {
+		return err
+	}
+	switch {
+	case tgUser.Status == UserBlocked:
+		return ErrUserBlocked
+	case tgUser.Status == UserDenied:
+		return ErrUserDenied
+	case !isNew:
+		return nil
+	}
+
+	log.Printf("User %d `%s` asked for approval\n", user.ID, user.Name)
+	for _, id := range subscribers(EventRequests) {
+		for _, f := range frontends {
+			if asker, ok := f.(approvalAsker); ok {
+				err = asker.AskApproval(id, tgUser, note)
+			} else {
+				err = f.Send(id, Msg(MsgAdminAckApprove, user.ID))
+			}
+			if err != nil && err != ErrFrontendOffline {
+				log.Printf("Failed to ask %d for approval: %v\n", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ApproveUser lets user with id register nicknames. The user is told about it
+// through moderator's frontend, approval is undone if that fails
+func ApproveUser(moderator Sender, id int64) error {
+	if !moderator.IsModerator() {
+		return ErrModeratorOnly
+	}
+	added, err := tgUsers.Approve(id, moderator.ID)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrAlreadyApproved
+	}
+
+	if err := moderator.Frontend.Send(id, Msg(MsgApproved)); err != nil {
+		tgUsers.Revoke(id)
+		return err
+	}
+	log.Printf("New user allowed by %d: %d\n", moderator.ID, id)
+	return nil
+}
+
+// DenyUser rejects approval request. Denied user may ask again after DeniedRequestCooldown
+func DenyUser(moderator Sender, id int64) error {
+	return decideUser(moderator, id, UserDenied, MsgDenied)
+}
+
+// BlockUser rejects user forever, their messages are ignored
+func BlockUser(moderator Sender, id int64) error {
+	return decideUser(moderator, id, UserBlocked, MsgBlocked)
+}
+
+func decideUser(moderator Sender, id int64, status string, reply MessageKey) error {
+	if !moderator.IsModerator() {
+		return ErrModeratorOnly
+	}
+	if isModerator(id) {
+		return errors.New("can't deny moderators")
+	}
+	if err := tgUsers.Decide(id, moderator.ID, status); err != nil {
+		return err
+	}
+	log.Printf("User %d is %s by %d\n", id, status, moderator.ID)
+	moderator.Frontend.Send(id, Msg(reply))
+	return nil
+}
+
+// ApproveMember approves user who is a member of one of AutoApproveChats.
+// Nicknames suspended when the user left are enabled again
+func ApproveMember(user Sender, chatID int64) error {
+	if u, known := tgUsers.Get(user.ID); known {
+		switch u.Status {
+		case UserBlocked:
+			return ErrUserBlocked
+		case UserDenied:
+			return ErrUserDenied
+		}
+	}
+
+	suspended, err := tgUsers.ApproveMember(user.ID, chatID, user.Name, user.LangCode)
+	if err != nil {
+		return err
+	}
+	for _, nickname := range suspended {
+		err := storage.UpdateRecord(nickname, func(r *StorageRecord) error {
+			if r.ID != user.ID {
+				return ErrAccessDenied
+			}
+			r.Disabled = false
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to enable nickname %s: %v\n", nickname, err)
+		}
+	}
+
+	msg := fmt.Sprintf("User `%s` (ID %d) approved as member of chat %d\n", user.Name, user.ID, chatID)
+	if len(suspended) > 0 {
+		msg = fmt.Sprintf("User `%s` (ID %d) is back in chat %d, enabled: %s\n", user.Name, user.ID, chatID, strings.Join(suspended, ", "))
+	}
+	log.Print(msg)
+	notify(EventUsers, msg)
+	return nil
+}
+
+// SuspendMember disables nicknames of user who left AutoApproveChats and takes back approval
+func SuspendMember(user TgUser) error {
+	records, err := storage.FindByTgID(user.ID)
+	if err != nil {
+		return err
+	}
+	// Keep earlier suspended ones, the sweep may be interrupted halfway
+	suspended := user.Suspended
+	for _, record := range records {
+		if record.Disabled {
+			continue
+		}
+		err := storage.UpdateRecord(record.Nickname, func(r *StorageRecord) error {
+			r.Disabled = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		suspended = append(suspended, record.Nickname)
+	}
+	if err := tgUsers.Suspend(user.ID, suspended); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("User `%s` (ID %d) left the chat, suspended: %s\n", user.Name, user.ID, strings.Join(suspended, ", "))
+	log.Print(msg)
+	notify(EventUsers, msg)
+	return nil
+}
+
+// CreateInvite makes invite code for maxUses new users. Admin isn't limited by quota
+func CreateInvite(user Sender, maxUses int) (Invite, error) {
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	if !user.IsAdmin() {
+		maxUses = min(maxUses, cfg.InviteMaxUses)
+		if invites.CountActive(user.ID) >= cfg.InviteQuota {
+			return Invite{}, ErrInviteQuota
+		}
+	}
+
+	inv, err := invites.Create(user.ID, maxUses, cfg.InviteTTL)
+	if err != nil {
+		return Invite{}, err
+	}
+	log.Printf("User `%s` created invite for %d users\n", user.Name, inv.MaxUses)
+	return inv, nil
+}
+
+// RedeemInvite approves user who came with invite code
+func RedeemInvite(user Sender, code string) error {
+	if user.IsAdmin() {
+		return ErrAlreadyApproved
+	}
+	if u, known := tgUsers.Get(user.ID); known {
+		switch {
+		case u.Approved:
+			return ErrAlreadyApproved
+		case u.Status == UserBlocked:
+			return ErrUserBlocked
+		case u.Status == UserDenied:
+			return ErrUserDenied
+		}
+	}
+
+	inv, err := invites.Use(code, user.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tgUsers.ApproveInvited(user.ID, inv.CreatedBy, user.Name, user.LangCode); err != nil {
+		if err := invites.Unuse(code, user.ID); err != nil {
+			log.Printf("Error giving back use of invite %s: %v\n", code, err)
+		}
+		return err
+	}
+
+	inviter, _ := tgUsers.Get(inv.CreatedBy)
+	msg := fmt.Sprintf("User `%s` (ID %d) joined with invite of `%s`\n", user.Name, user.ID, inviter.Name)
+	log.Print(msg)
+	notify(EventUsers, msg)
+	return nil
+}
+
+// RegisterNickname creates a record for nickname. Returned record has plaintext token of its only key
+func RegisterNickname(user Sender, nickname string) (*StorageRecord, error) {
+	if !isValidMinecraftUsername(nickname) {
+		return nil, ErrBadNickname
+	}
+
+	tomb, _ := storage.FindTombstone(nickname)
+	record, err := storage.AddRecord(nickname, user.Name, user.ID)
+	if err == ErrNicknameReserved && user.IsAdmin() {
+		// Admin may take over reserved nickname
+		if err = storage.ReleaseNickname(nickname); err == nil {
+			record, err = storage.AddRecord(nickname, user.Name, user.ID)
+		}
+	}
+	if err == ErrNicknameExists || err == ErrNicknameReserved {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("!!!!!!!!!!!!!!!!!!!\n %s", err.Error())
+		notify(EventErrors, err.Error())
+		return nil, err
+	}
+
+	msg := fmt.Sprintf("User `%s` registered nickname: %s\n", record.TgName, record.Nickname)
+	if tomb != nil {
+		msg = fmt.Sprintf("User `%s` re-claimed nickname: %s (deleted %s by `%s`)\n", record.TgName, record.Nickname,
+			tomb.DeletedAt.Format("2006-01-02 15:04"), tomb.PrevOwnerName)
+	}
+	log.Print(msg)
+	notify(EventNicknames, msg)
+	return record, nil
+}
+
+// ListNicknames returns records of user
+func ListNicknames(user Sender) ([]StorageRecord, error) {
+	return storage.FindByTgID(user.ID)
+}
+
+// DeleteNickname removes nickname of user. Returns until when it stays
+// reserved for the user, zero time if it doesn't
+func DeleteNickname(user Sender, nickname string) (time.Time, error) {
+	if err := storage.DeleteByNickname(nickname, user.ID); err != nil {
+		return time.Time{}, err
+	}
+
+	msg := fmt.Sprintf("User `%s` deleted nickname: %s\n", user.Name, nickname)
+	log.Print(msg)
+	notify(EventNicknames, msg)
+	return reservedUntil(nickname), nil
+}
+
+// SearchRecords returns records with query in nickname or owner name, or owned by
+// Telegram ID query, sorted by nickname. Empty query returns all records
+func SearchRecords(admin Sender, query string) ([]StorageRecord, error) {
+	if !admin.IsAdmin() {
+		return nil, ErrAdminOnly
+	}
+	query = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "@"))
+	id, _ := strconv.ParseInt(query, 10, 64)
+
+	var result []StorageRecord
+	storage.ForEach(func(r StorageRecord) bool {
+		if query == "" || (id != 0 && r.ID == id) ||
+			strings.Contains(strings.ToLower(r.Nickname), query) ||
+			strings.Contains(strings.ToLower(r.TgName), query) {
+			result = append(result, r)
+		}
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Nickname) < strings.ToLower(result[j].Nickname)
+	})
+	return result, nil
+}
+
+// ForceDeleteNickname removes nickname of any user. It stays reserved for the
+// owner like after their own deletion
+func ForceDeleteNickname(admin Sender, nickname string) error {
+	if !admin.IsAdmin() {
+		return ErrAdminOnly
+	}
+	record, err := storage.FindByNickname(nickname)
+	if err != nil {
+		return err
+	}
+	if err := storage.DeleteByNickname(record.Nickname, record.ID); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Admin `%s` deleted nickname %s of `%s` (ID %d)\n", admin.Name, record.Nickname, record.TgName, record.ID)
+	log.Print(msg)
+	notify(EventNicknames, msg)
+	return nil
+}
+
+// SuspendNickname disables or enables login with nickname of any user
+func SuspendNickname(admin Sender, nickname string, suspend bool) error {
+	if !admin.IsAdmin() {
+		return ErrAdminOnly
+	}
+	err := storage.UpdateRecord(nickname, func(r *StorageRecord) error {
+		nickname = r.Nickname
+		r.Disabled = suspend
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	action := "enabled"
+	if suspend {
+		action = "suspended"
+	}
+	msg := fmt.Sprintf("Admin `%s` %s nickname %s\n", admin.Name, action, nickname)
+	log.Print(msg)
+	notify(EventNicknames, msg)
+	return nil
+}
+
+// TransferNickname gives nickname to another user, who becomes approved. All access keys
+// are replaced with a new one, so the previous owner can't log in anymore.
+// Returned record has plaintext token of its only key
+func TransferNickname(admin Sender, nickname string, newOwner int64) (*StorageRecord, error) {
+	if !admin.IsAdmin() {
+		return nil, ErrAdminOnly
+	}
+	owner, _ := tgUsers.Get(newOwner)
+	token := generateToken()
+	var prev StorageRecord
+	err := storage.UpdateRecord(nickname, func(r *StorageRecord) error {
+		if r.ID == newOwner {
+			return errors.New("nickname already belongs to this user")
+		}
+		prev = *r
+		r.ID = newOwner
+		r.TgName = owner.Name
+		r.Guest = false
+		r.Keys = []AccessKey{{ID: 1, Label: DefaultKeyLabel, Token: token, CreatedAt: time.Now()}}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tgUsers.Approve(newOwner, admin.ID); err != nil {
+		log.Printf("Failed to approve new owner %d: %v\n", newOwner, err)
+	}
+
+	record, err := storage.FindByNickname(nickname)
+	if err != nil {
+		return nil, err
+	}
+	record.Keys[0].Token = token
+
+	msg := fmt.Sprintf("Admin `%s` transferred nickname %s from `%s` (ID %d) to `%s` (ID %d)\n",
+		admin.Name, record.Nickname, prev.TgName, prev.ID, owner.Name, newOwner)
+	log.Print(msg)
+	notify(EventNicknames, msg)
+	return record, nil
+}
+
+// ListSessions returns live game sessions, oldest first
+func ListSessions(moderator Sender) ([]SessionInfo, error) {
+	if !moderator.IsModerator() {
+		return nil, ErrModeratorOnly
+	}
+	return listSessions(), nil
+}
+
+// KickPlayer closes all sessions of nickname. Returns number of closed sessions
+func KickPlayer(moderator Sender, nickname string) (int, error) {
+	if !moderator.IsModerator() {
+		return 0, ErrModeratorOnly
+	}
+	kicked := kickNickname(nickname)
+	if kicked == 0 {
+		return 0, ErrNotOnline
+	}
+	log.Printf("Moderator `%s` kicked %s\n", moderator.Name, nickname)
+	return kicked, nil
+}
+
+// StartMaintenance keeps everyone except admins out of the server until StopMaintenance.
+// until is only shown to players, zero if unknown. Returns number of kicked players
+func StartMaintenance(admin Sender, reason string, until time.Time) (int, error) {
+	if !admin.IsAdmin() {
+		return 0, ErrAdminOnly
+	}
+	m := &Maintenance{Reason: reason, Until: until, StartedBy: admin.ID, StartedAt: time.Now()}
+	if prev := appState.Maintenance(); prev != nil {
+		// Only reason and end are changed
+		m.StartedBy, m.StartedAt = prev.StartedBy, prev.StartedAt
+	}
+	if err := appState.SetMaintenance(m); err != nil {
+		return 0, err
+	}
+	kicked := kickSessions(func(s *Session) bool { return !s.Admin })
+	updateStatusBoards()
+
+	msg := fmt.Sprintf("🔧 Admin `%s` turned maintenance mode on, %d players kicked\n", admin.Name, kicked)
+	log.Print(msg)
+	notify(EventServer, msg)
+	return kicked, nil
+}
+
+// StopMaintenance lets everyone in again
+func StopMaintenance(admin Sender) error {
+	if !admin.IsAdmin() {
+		return ErrAdminOnly
+	}
+	if appState.Maintenance() == nil {
+		return ErrNoMaintenance
+	}
+	if err := appState.SetMaintenance(nil); err != nil {
+		return err
+	}
+	updateStatusBoards()
+
+	msg := fmt.Sprintf("✅ Admin `%s` turned maintenance mode off\n", admin.Name)
+	log.Print(msg)
+	notify(EventServer, msg)
+	return nil
+}
+
+// reservedUntil returns end of deleted nickname reservation, zero time if there is none
+func reservedUntil(nickname string) time.Time {
+	tomb, err := storage.FindTombstone(nickname)
+	if err != nil {
+		return time.Time{}
+	}
+	return tomb.DeletedAt.Add(cfg.NicknameCooldown)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What happens when a nickname that is already playing logs in again, Config.ConcurrentLogins
+const (
+	LoginsAllow   = "allow"   // Both stay, the server decides, usually kicking the first one
+	LoginsReject  = "reject"  // The new connection is refused, unless it comes from the same IP
+	LoginsReplace = "replace" // The old connection is closed
+)
+
+// Owner is warned about logins from another IP at most this often per nickname
+const ConcurrentLoginWarnInterval = time.Minute * 10
+
+var ErrAlreadyPlaying = errors.New("nickname is already playing")
+
+// Session is a live game connection through the proxy. Kicking closes
+// both sides, the login handler then cleans up as after normal disconnect
+type Session struct {
+	ID        uint64
+	Nickname  string
+	OwnerID   int64
+	OwnerName string
+	KeyID     int
+	KeyLabel  string
+	Admin     bool // May stay during maintenance
+	ClientIP  string
+	Protocol  int
+	StartedAt time.Time
+	BytesIn   atomic.Int64 // From client to server
+	BytesOut  atomic.Int64 // From server to client
+
+	mu     sync.Mutex
+	client net.Conn
+	server net.Conn
+	closed bool
+}
+
+// SessionInfo is a copy of session fields for listings
+type SessionInfo struct {
+	ID        uint64    `json:"id"`
+	Nickname  string    `json:"nickname"`
+	OwnerID   int64     `json:"owner_id"`
+	OwnerName string    `json:"owner_name"`
+	KeyID     int       `json:"key_id"`
+	KeyLabel  string    `json:"key_label"`
+	ClientIP  string    `json:"client_ip"`
+	Protocol  int       `json:"protocol"`
+	StartedAt time.Time `json:"started_at"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+}
+
+var (
+	sessions = struct {
+		sync.RWMutex
+		nextID uint64
+		byID   map[uint64]*Session
+	}{
+		byID: make(map[uint64]*Session),
+	}
+
+	// Lowercase nickname -> last warning about concurrent login
+	concurrentWarnings = struct {
+		sync.Mutex
+		last map[string]time.Time
+	}{
+		last: make(map[string]time.Time),
+	}
+)
+
+// attachServer remembers connection to the server, so kick closes it too.
+// Returns false if the session was already closed
+func (s *Session) attachServer(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.server = conn
+	return true
+}
+
+// Close closes both connections of session
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.client.Close()
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+func (s *Session) Info() SessionInfo {
+	return SessionInfo{
+		ID:        s.ID,
+		Nickname:  s.Nickname,
+		OwnerID:   s.OwnerID,
+		OwnerName: s.OwnerName,
+		KeyID:     s.KeyID,
+		KeyLabel:  s.KeyLabel,
+		ClientIP:  s.ClientIP,
+		Protocol:  s.Protocol,
+		StartedAt: s.StartedAt,
+		BytesIn:   s.BytesIn.Load(),
+		BytesOut:  s.BytesOut.Load(),
+	}
+}
+
+// startSession registers login of record with key over client connection,
+// applying Config.ConcurrentLogins to other sessions of the nickname.
+// Returns ErrAlreadyPlaying if the login is rejected
+func startSession(client net.Conn, record *StorageRecord, key *AccessKey, clientIP string, protocol int) (*Session, error) {
+	session := &Session{
+		Nickname:  record.Nickname,
+		OwnerID:   record.ID,
+		OwnerName: record.TgName,
+		KeyID:     key.ID,
+		KeyLabel:  key.Label,
+		Admin:     maintenanceAllows(record, key),
+		ClientIP:  clientIP,
+		Protocol:  protocol,
+		StartedAt: time.Now(),
+		client:    client,
+	}
+
+	sessions.Lock()
+	var others []*Session
+	sameIP := true
+	for _, other := range sessions.byID {
+		if strings.EqualFold(other.Nickname, record.Nickname) {
+			others = append(others, other)
+			sameIP = sameIP && other.ClientIP == clientIP
+		}
+	}
+	policy := cfg.ConcurrentLogins
+	if policy == LoginsReject && sameIP {
+		// Most likely the client reconnects after a crash, while the old connection hangs
+		policy = LoginsReplace
+	}
+	if policy == LoginsReject && len(others) > 0 {
+		sessions.Unlock()
+		warnConcurrentLogin(session, others[0], MsgConcurrentLoginRejected)
+		return nil, ErrAlreadyPlaying
+	}
+	sessions.nextID++
+	session.ID = sessions.nextID
+	sessions.byID[session.ID] = session
+	sessions.Unlock()
+
+	if policy == LoginsReplace {
+		for _, other := range others {
+			log.Printf("Closing previous session of %s from %s\n", other.Nickname, other.ClientIP)
+			other.Close()
+			if other.ClientIP != clientIP {
+				warnConcurrentLogin(session, other, MsgConcurrentLoginReplaced)
+			}
+		}
+	}
+	updateStatusBoards()
+	return session, nil
+}
+
+// warnConcurrentLogin tells owner of nickname in background that someone else logged in while they were playing
+func warnConcurrentLogin(session, other *Session, key MessageKey) {
+	lower := strings.ToLower(session.Nickname)
+	concurrentWarnings.Lock()
+	if time.Since(concurrentWarnings.last[lower]) < ConcurrentLoginWarnInterval {
+		concurrentWarnings.Unlock()
+		return
+	}
+	concurrentWarnings.last[lower] = time.Now()
+	concurrentWarnings.Unlock()
+
+	// Login doesn't wait for Telegram
+	go tellUser(session.OwnerID, Msg(key, session.Nickname, session.ClientIP, session.KeyLabel, other.ClientIP))
+}
+
+// endSession forgets closed session
+func endSession(session *Session) {
+	session.Close()
+
+	sessions.Lock()
+	delete(sessions.byID, session.ID)
+	if len(sessions.byID) == 0 {
+		go updateServerStatus()
+	}
+	sessions.Unlock()
+	updateStatusBoards()
+}
+
+// listSessions returns all live sessions, oldest first
+func listSessions() []SessionInfo {
+	sessions.RLock()
+	result := make([]SessionInfo, 0, len(sessions.byID))
+	for _, session := range sessions.byID {
+		result = append(result, session.Info())
+	}
+	sessions.RUnlock()
+
+	slices.SortFunc(result, func(a, b SessionInfo) int { return a.StartedAt.Compare(b.StartedAt) })
+	return result
+}
+
+// keyInUse reports whether someone plays with key of nickname now
+func keyInUse(nickname string, keyID int) bool {
+	sessions.RLock()
+	defer sessions.RUnlock()
+
+	for _, session := range sessions.byID {
+		if session.KeyID == keyID && strings.EqualFold(session.Nickname, nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// kickSessions closes every session for which match returns true.
+// Returns number of closed sessions
+func kickSessions(match func(s *Session) bool) int {
+	var matched []*Session
+	sessions.RLock()
+	for _, session := range sessions.byID {
+		if match(session) {
+			matched = append(matched, session)
+		}
+	}
+	sessions.RUnlock()
+
+	for _, session := range matched {
+		session.Close()
+	}
+	return len(matched)
+}
+
+// kickNickname closes all sessions of nickname
+func kickNickname(nickname string) int {
+	return kickSessions(func(s *Session) bool { return strings.EqualFold(s.Nickname, nickname) })
+}
+
+// kickRevoked closes sessions that logged in with keys which no longer work
+func kickRevoked(nickname string, keyIDs []int) {
+	kicked := kickSessions(func(s *Session) bool {
+		return strings.EqualFold(s.Nickname, nickname) && slices.Contains(keyIDs, s.KeyID)
+	})
+	if kicked > 0 {
+		log.Printf("Closed %d session(s) of %s after access was revoked\n", kicked, nickname)
+	}
+}
+
+// formatBytes formats n as `512 B`, `1.5 KB`, `20.3 MB`...
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// countingWriter adds number of written bytes to counter
+type countingWriter struct {
+	w       net.Conn
+	counter *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSessionStorage sets global storage with revocations kicking sessions, as in main
+func testSessionStorage(t *testing.T) *Storage {
+	t.Helper()
+	s, err := NewStorage(&tsvBackend{filename: filepath.Join(t.TempDir(), "data.txt")}, testHashKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.OnRevoke(kickRevoked)
+	storage = s
+	if cfg.MinecraftServer == "" {
+		// Checked in background once the last session ends
+		cfg.MinecraftServer = "127.0.0.1:1"
+	}
+	t.Cleanup(func() {
+		sessions.Lock()
+		clear(sessions.byID)
+		sessions.Unlock()
+		concurrentWarnings.Lock()
+		clear(concurrentWarnings.last)
+		concurrentWarnings.Unlock()
+	})
+	return s
+}
+
+// testLogin starts session as the proxy does on login, counting the use of key
+func testLogin(t *testing.T, record *StorageRecord, key *AccessKey, ip string) (*Session, error) {
+	t.Helper()
+	client, _ := net.Pipe()
+	session, err := startSession(client, record, key, ip, 767)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.UpdateRecord(record.Nickname, func(r *StorageRecord) error {
+		if usedKey, ok := r.Key(key.ID); ok {
+			usedKey.Uses++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, nil
+}
+
+func isClosed(s *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func TestGuestSweepKeepsLastSession(t *testing.T) {
+	s := testSessionStorage(t)
+	record, key, err := s.IssueGuestPass("Friend", "friend", 1, GuestPass{MaxUses: 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := testLogin(t, record, key, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.RemoveExpired(time.Now(), keyInUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 || isClosed(session) {
+		t.Fatalf("last allowed session was kicked, removed %d", removed)
+	}
+	if _, _, err := s.FindByToken(key.Token); err != nil {
+		t.Fatal("pass removed while in use:", err)
+	}
+
+	endSession(session)
+	if removed, err := s.RemoveExpired(time.Now(), keyInUse); err != nil || removed != 1 {
+		t.Fatalf("used up pass wasn't removed after the session: %d %v", removed, err)
+	}
+	if _, err := s.FindByNickname("Friend"); err == nil {
+		t.Fatal("guest record left without keys")
+	}
+}
+
+func TestGuestSweepKicksTimedOut(t *testing.T) {
+	s := testSessionStorage(t)
+	record, key, err := s.IssueGuestPass("Friend", "friend", 1, GuestPass{Duration: time.Hour}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := testLogin(t, record, key, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := s.RemoveExpired(time.Now().Add(time.Hour*2), keyInUse); err != nil || removed != 1 {
+		t.Fatalf("timed out pass wasn't removed: %d %v", removed, err)
+	}
+	if !isClosed(session) {
+		t.Fatal("session of timed out pass wasn't kicked")
+	}
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	tests := []struct {
+		policy      string
+		secondIP    string
+		rejected    bool
+		firstClosed bool
+	}{
+		{LoginsAllow, "10.0.0.2", false, false},
+		{LoginsReject, "10.0.0.2", true, false},
+		{LoginsReject, "10.0.0.1", false, true}, // Reconnect replaces the hung session
+		{LoginsReplace, "10.0.0.2", false, true},
+		{LoginsReplace, "10.0.0.1", false, true},
+	}
+	policy := cfg.ConcurrentLogins
+	t.Cleanup(func() { cfg.ConcurrentLogins = policy })
+
+	for _, tt := range tests {
+		t.Run(tt.policy+" from "+tt.secondIP, func(t *testing.T) {
+			s := testSessionStorage(t)
+			cfg.ConcurrentLogins = tt.policy
+			record, err := s.AddRecord("Steve", "steve", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := testLogin(t, record, &record.Keys[0], "10.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := testLogin(t, record, &record.Keys[0], tt.secondIP)
+			if tt.rejected != (err == ErrAlreadyPlaying) || !tt.rejected && err != nil {
+				t.Fatalf("second login: %v", err)
+			}
+			if isClosed(first) != tt.firstClosed {
+				t.Fatalf("first session closed: %v", isClosed(first))
+			}
+			if second != nil && isClosed(second) {
+				t.Fatal("second session closed")
+			}
+		})
+	}
+}
+
+func TestRevokedKeyIsKicked(t *testing.T) {
+	s := testSessionStorage(t)
+	record, err := s.AddRecord("Steve", "steve", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.AddKey("Steve", 1, "phone"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := testLogin(t, record, &record.Keys[0], "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := testLogin(t, record, &AccessKey{ID: 2, Label: "phone"}, "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.RotateToken("Steve", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if isClosed(first) || !isClosed(phone) {
+		t.Fatalf("after /regen of phone: first closed %v, phone closed %v", isClosed(first), isClosed(phone))
+	}
+	if err := s.DeleteByNickname("Steve", 1); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(first) {
+		t.Fatal("session of deleted nickname wasn't kicked")
+	}
+}
+
+func TestMaintenanceAllows(t *testing.T) {
+	admins := cfg.Admins
+	cfg.Admins = []int64{1}
+	t.Cleanup(func() { cfg.Admins = admins })
+
+	key := &AccessKey{ID: 1, Label: "main"}
+	guestKey := &AccessKey{ID: 2, Label: GuestKeyLabel, MaxUses: 1}
+	tests := []struct {
+		name   string
+		record StorageRecord
+		key    *AccessKey
+		allow  bool
+	}{
+		{"admin", StorageRecord{Nickname: "Admin", ID: 1}, key, true},
+		{"admin guest key", StorageRecord{Nickname: "Admin", ID: 1}, guestKey, false},
+		{"guest record of admin", StorageRecord{Nickname: "Friend", ID: 1, Guest: true}, guestKey, false},
+		{"player", StorageRecord{Nickname: "Steve", ID: 2}, key, false},
+	}
+	for _, tt := range tests {
+		if got := maintenanceAllows(&tt.record, tt.key); got != tt.allow {
+			t.Errorf("%s: got %v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const DefaultStateFile = "state.json"
+
+// State is what the proxy changes at runtime and keeps across restarts,
+// so config.toml is never rewritten
+type State struct {
+	Boards      []StatusBoard `json:"boards"`
+	Maintenance *Maintenance  `json:"maintenance,omitempty"` // Nil if it's off
+}
+
+// StateStore keeps State in memory and saves it as a whole JSON file on every change
+type StateStore struct {
+	filename string
+	mu       sync.Mutex
+	state    State
+}
+
+// NewStateStore loads state from file. created is true if the file didn't exist
+func NewStateStore(filename string) (store *StateStore, created bool, err error) {
+	store = &StateStore{filename: filename}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, &store.state); err != nil {
+		return nil, false, err
+	}
+	return store, false, nil
+}
+
+// Boards returns copy of all status boards
+func (s *StateStore) Boards() []StatusBoard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]StatusBoard(nil), s.state.Boards...)
+}
+
+// SetBoard adds status board, replacing the previous one in the same chat.
+// Returns the replaced board
+func (s *StateStore) SetBoard(board StatusBoard) (*StatusBoard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backup := s.state.Boards
+	var replaced *StatusBoard
+	boards := []StatusBoard{}
+	for _, b := range s.state.Boards {
+		if b.ChatID == board.ChatID {
+			replaced = &b
+			continue
+		}
+		boards = append(boards, b)
+	}
+	s.state.Boards = append(boards, board)
+	if err := s.save(); err != nil {
+		s.state.Boards = backup
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// RemoveBoard removes status board of chat, nil if there is none
+func (s *StateStore) RemoveBoard(chatID int64) (*StatusBoard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backup := s.state.Boards
+	var removed *StatusBoard
+	boards := []StatusBoard{}
+	for _, b := range s.state.Boards {
+		if b.ChatID == chatID {
+			removed = &b
+			continue
+		}
+		boards = append(boards, b)
+	}
+	if removed == nil {
+		return nil, nil
+	}
+	s.state.Boards = boards
+	if err := s.save(); err != nil {
+		s.state.Boards = backup
+		return nil, err
+	}
+	return removed, nil
+}
+
+// Maintenance returns copy of maintenance mode, nil if it's off
+func (s *StateStore) Maintenance() *Maintenance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state.Maintenance == nil {
+		return nil
+	}
+	m := *s.state.Maintenance
+	return &m
+}
+
+// SetMaintenance turns maintenance mode on, or off if m is nil
+func (s *StateStore) SetMaintenance(m *Maintenance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backup := s.state.Maintenance
+	s.state.Maintenance = m
+	if err := s.save(); err != nil {
+		s.state.Maintenance = backup
+		return err
+	}
+	return nil
+}
+
+// save writes state to file. Caller must hold lock
+func (s *StateStore) save() error {
+	return writeFileAtomic(s.filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(s.state)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server list response of the proxy itself, while the server is offline
+// or during maintenance
+
+const DefaultOfflineVersion = "Some server"
+
+// Loaded from Config.OfflineFavicon on start
+var offlineFavicon string
+
+// loadFavicon reads 64x64 PNG file as data URI for status response
+func loadFavicon(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	img, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("favicon %s: %w", filename, err)
+	}
+	if img.Width != 64 || img.Height != 64 {
+		return "", fmt.Errorf("favicon %s must be 64x64, not %dx%d", filename, img.Width, img.Height)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// isJSONComponent reports whether text should be sent as is, not as plain text
+func isJSONComponent(text string) bool {
+	text = strings.TrimSpace(text)
+	return strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[")
+}
+
+// textComponent makes chat component of plain text, which may have § formatting codes
+func textComponent(text string) json.RawMessage {
+	data, _ := json.Marshal(StatusDescriptionJSON{Text: text})
+	return data
+}
+
+// restartETA returns when the server is expected back, zero if it's unknown
+func restartETA() time.Time {
+	if cfg.RestartDuration <= 0 {
+		return time.Time{}
+	}
+	serverStatus.RLock()
+	since := serverStatus.since
+	isOnline := serverStatus.isOnline
+	serverStatus.RUnlock()
+
+	eta := since.Add(cfg.RestartDuration)
+	if isOnline || since.IsZero() || eta.Before(time.Now()) {
+		return time.Time{}
+	}
+	return eta
+}
+
+// offlineStatus is shown in the server list while the server doesn't respond
+func offlineStatus(protocol int) StatusJSON {
+	motd := textComponent(Msg(MsgStatusOffline))
+	if isJSONComponent(cfg.OfflineMOTD) {
+		motd = json.RawMessage(cfg.OfflineMOTD)
+	} else if cfg.OfflineMOTD != "" {
+		motd = textComponent(cfg.OfflineMOTD)
+	}
+	if eta := restartETA(); !eta.IsZero() {
+		// Parent component without own text, so the MOTD keeps its style
+		data, _ := json.Marshal(map[string]any{
+			"text":  "",
+			"extra": []any{motd, StatusDescriptionJSON{Text: "\n§7" + Msg(MsgRestartETA, formatClock(eta))}},
+		})
+		motd = data
+	}
+
+	return StatusJSON{
+		Version: StatusVersionJSON{
+			Name:     cfg.OfflineVersion,
+			Protocol: protocol,
+		},
+		Players: StatusPlayersJSON{
+			Max: cfg.OfflineMaxPlayers,
+		},
+		Description: motd,
+		Favicon:     offlineFavicon,
+	}
+}
+
+// maintenanceStatus is shown in the server list during maintenance, the server isn't asked
+func maintenanceStatus(m *Maintenance) StatusJSON {
+	return StatusJSON{
+		Version: StatusVersionJSON{
+			Name:     "Maintenance",
+			Protocol: -1, // Client shows the name in red
+		},
+		Players: StatusPlayersJSON{
+			Max:    cfg.OfflineMaxPlayers,
+			Online: len(getOnlinePlayers()),
+		},
+		Description: textComponent(m.Describe()),
+		Favicon:     offlineFavicon,
+	}
+}
@@ -2,67 +2,764 @@ package main
 
 import (
 	"bufio"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// StorageRecordVersion is the current record schema version.
+// 0/1 - token, nickname, ID, TgName only
+// 2 - added creation time, last login, last IP, sessions count and disabled flag
+// 3 - single token replaced with a list of labelled access keys
+// 4 - tokens are stored as keyed hashes only
+// 5 - guest passes: expiring keys and records created for guests
+const StorageRecordVersion = 5
+
+const (
+	DefaultKeyLabel     = "main"
+	MaxKeysPerRecord    = 10
+	DefaultTokenKeyFile = "token.key"
+	// Token hashes are indexed by this many leading hex chars,
+	// full hashes are then compared in constant time
+	tokenHashPrefixLen = 8
+	tokenHintLen       = 4
+)
+
+// AccessKey is one of the tokens that let a player log in with record's nickname.
+// Only a keyed hash of the token is stored, plaintext is known just once, when
+// the key is created or rotated
+type AccessKey struct {
+	ID        int       `json:"id"` // Unique within the record
+	Label     string    `json:"label"`
+	Hash      string    `json:"hash"`            // Hex HMAC-SHA256 of token
+	Hint      string    `json:"hint"`            // First chars of token, to tell keys apart
+	Token     string    `json:"token,omitempty"` // Fresh keys and files before v4 only
+	CreatedAt time.Time `json:"created_at"`
+	// Guest passes only
+	ExpiresAt time.Time `json:"expires_at"` // Zero if never expires
+	MaxUses   int       `json:"max_uses"`   // Logins allowed, 0 if unlimited
+	Uses      int       `json:"uses"`
+	IssuedBy  int64     `json:"issued_by"`
+}
+
+// IsGuest reports whether key is a guest pass
+func (k *AccessKey) IsGuest() bool {
+	return !k.ExpiresAt.IsZero() || k.MaxUses > 0
+}
+
+// Expired reports whether guest pass ran out of time or logins
+func (k *AccessKey) Expired(now time.Time) bool {
+	return k.TimedOut(now) || k.MaxUses > 0 && k.Uses >= k.MaxUses
+}
+
+// TimedOut reports whether guest pass ran out of time. Pass that ran out of
+// logins still lets its last session play
+func (k *AccessKey) TimedOut(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// GuestPass describes limits of a new guest key
+type GuestPass struct {
+	Duration time.Duration // 0 if not limited by time
+	MaxUses  int           // 0 if not limited by logins
+}
+
 // Record represents a single storage entry
 type StorageRecord struct {
-	Token    string
-	Nickname string
-	ID       int64
-	TgName   string
+	Version   int         `json:"v"`
+	Token     string      `json:"token,omitempty"` // Before v3 only, moved to Keys on load
+	Keys      []AccessKey `json:"keys"`
+	Nickname  string      `json:"nickname"`
+	ID        int64       `json:"id"`
+	TgName    string      `json:"tg_name"`
+	CreatedAt time.Time   `json:"created_at"` // Zero for records created before v2
+	LastSeen  time.Time   `json:"last_seen"`  // Last successful login
+	LastIP    string      `json:"last_ip"`
+	Sessions  int         `json:"sessions"` // Total successful logins
+	Disabled  bool        `json:"disabled"` // Suspended records can't log in
+	Guest     bool        `json:"guest"`    // Created for guest pass, removed with its last key
 }
 
-// Storage implements thread-safe storage for records
+// Key returns access key by its ID
+func (r *StorageRecord) Key(keyID int) (*AccessKey, bool) {
+	for i := range r.Keys {
+		if r.Keys[i].ID == keyID {
+			return &r.Keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// clone returns a deep copy, so callers can't modify stored keys
+func (r StorageRecord) clone() StorageRecord {
+	r.Keys = append([]AccessKey(nil), r.Keys...)
+	return r
+}
+
+// upgrade converts record loaded from older format to the current version
+func (r *StorageRecord) upgrade() {
+	if r.Token != "" && len(r.Keys) == 0 {
+		r.Keys = []AccessKey{{ID: 1, Label: DefaultKeyLabel, Token: r.Token, CreatedAt: r.CreatedAt}}
+	}
+	r.Token = ""
+	// Older records just miss new fields, zero values are fine for them
+	r.Version = StorageRecordVersion
+}
+
+// RecordStore is what the rest of the proxy needs from record storage.
+// Methods taking owner id fail with ErrAccessDenied for nicknames of other users
+type RecordStore interface {
+	// AddRecord registers nickname with a single access key
+	AddRecord(nickname, tgname string, id int64) (*StorageRecord, error)
+	// FindByToken returns record and the access key the token belongs to
+	FindByToken(token string) (*StorageRecord, *AccessKey, error)
+	FindByNickname(nickname string) (*StorageRecord, error)
+	FindByTgID(id int64) ([]StorageRecord, error)
+	DeleteByNickname(nickname string, id int64) error
+	// AddKey creates one more access key for the nickname, guest nicknames get only guest passes
+	AddKey(nickname string, id int64, label string) (*StorageRecord, *AccessKey, error)
+	// RevokeKey removes access key, the last key of a nickname can't be revoked
+	RevokeKey(nickname string, id int64, keyID int) error
+	// RotateToken replaces token of the access key, old token stops working at once
+	RotateToken(nickname string, id int64, keyID int) (*StorageRecord, *AccessKey, error)
+	// IssueGuestPass adds expiring key to nickname of id, or registers nickname for a guest.
+	// anyOwner allows adding guest key to nickname of another user
+	IssueGuestPass(nickname, tgname string, id int64, pass GuestPass, anyOwner bool) (*StorageRecord, *AccessKey, error)
+	// RemoveExpired deletes expired guest keys and guest records left without keys.
+	// Keys that only ran out of logins are kept while inUse reports them in use
+	RemoveExpired(now time.Time, inUse func(nickname string, keyID int) bool) (int, error)
+	// UpdateRecord applies update to a copy of the record and saves it.
+	// Nickname can't be changed this way
+	UpdateRecord(nickname string, update func(r *StorageRecord) error) error
+	// ForEach calls fn for every record until fn returns false
+	ForEach(fn func(r StorageRecord) bool)
+	// FindTombstone returns active reservation of a deleted nickname
+	FindTombstone(nickname string) (*Tombstone, error)
+	// ReleaseNickname drops reservation of a deleted nickname
+	ReleaseNickname(nickname string) error
+	// ImportRecord adds record from a backup as is, replacing existing one only if replace is set
+	ImportRecord(r StorageRecord, replace bool) error
+	// KeyCheck identifies token key, records with hashes of another key can't be imported
+	KeyCheck() string
+	// OnRevoke sets fn to be called with keys that stopped working: removed, rotated,
+	// or all keys of deleted, suspended and transferred records
+	OnRevoke(fn func(nickname string, keyIDs []int))
+}
+
+// Tombstone keeps a deleted nickname reserved for its previous owner for a while,
+// so nobody else inherits character data left on the server
+type Tombstone struct {
+	Nickname      string    `json:"nickname"`
+	PrevOwner     int64     `json:"prev_owner"`
+	PrevOwnerName string    `json:"prev_owner_name"`
+	DeletedAt     time.Time `json:"deleted_at"`
+}
+
+// storageState is everything a backend keeps on disk
+type storageState struct {
+	Records    []StorageRecord
+	Tombstones []Tombstone
+	KeyCheck   string // Identifies token key the hashes were made with, empty in older files
+	Skipped    int    // Lines that couldn't be read, the file must not be rewritten then
+}
+
+// hasHashes reports whether any key is stored as hash, so it needs the existing token key
+func (state storageState) hasHashes() bool {
+	for _, r := range state.Records {
+		for _, key := range r.Keys {
+			if key.Hash != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordBackend persists records on disk for Storage.
+// snapshot returns current state with records in order, backends that can't
+// write a single change use it to rewrite everything
+type recordBackend interface {
+	load() (storageState, error)
+	// put saves record, dropping tombstone of its nickname
+	put(r StorageRecord, snapshot func() storageState) error
+	// delete removes record, leaving tomb in its place if it's not nil
+	delete(nickname string, tomb *Tombstone, snapshot func() storageState) error
+	// release drops tombstone of nickname
+	release(nickname string, snapshot func() storageState) error
+	// compact replaces everything stored with state
+	compact(state storageState) error
+}
+
+// Storage implements thread-safe storage for records.
+// All records are kept in memory and indexed by token hash and nickname,
+// the backend is only read once on startup and written on changes.
 type Storage struct {
-	filename string
+	backend  recordBackend
+	hashKey  []byte
+	cooldown time.Duration // How long deleted nicknames stay reserved
 	mu       sync.RWMutex
+
+	records    []*StorageRecord            // In file order
+	byHash     map[string][]*StorageRecord // token hash prefix -> records
+	byNickname map[string]*StorageRecord   // lowercase nickname -> record
+	tombstones map[string]*Tombstone       // lowercase nickname -> reservation
+
+	revoked func(nickname string, keyIDs []int) // Set once on startup
+}
+
+// NewStorage creates a new storage instance and loads records from backend.
+// Plaintext tokens from older files are replaced with hashes
+func NewStorage(backend recordBackend, hashKey []byte, cooldown time.Duration) (*Storage, error) {
+	state, err := backend.load()
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(backend, state, hashKey, cooldown)
+}
+
+func newStorage(backend recordBackend, state storageState, hashKey []byte, cooldown time.Duration) (*Storage, error) {
+	s := &Storage{
+		backend:    backend,
+		hashKey:    hashKey,
+		cooldown:   cooldown,
+		byHash:     make(map[string][]*StorageRecord),
+		byNickname: make(map[string]*StorageRecord),
+		tombstones: make(map[string]*Tombstone),
+	}
+
+	if state.Skipped > 0 {
+		// Every change rewrites or compacts the file sooner or later, losing them
+		return nil, fmt.Errorf("%d lines of storage file can't be read, fix or remove them", state.Skipped)
+	}
+	if state.KeyCheck != "" && state.KeyCheck != s.KeyCheck() && state.hasHashes() {
+		return nil, ErrOtherTokenKey
+	}
+
+	records := state.Records
+	hashed := 0
+	for i := range records {
+		records[i].upgrade()
+		for k := range records[i].Keys {
+			key := &records[i].Keys[k]
+			if key.Token != "" {
+				key.Hash = s.hashToken(key.Token)
+				key.Hint = tokenHint(key.Token)
+				key.Token = ""
+				hashed++
+			}
+		}
+		s.insert(&records[i])
+	}
+	for i := range state.Tombstones {
+		tomb := &state.Tombstones[i]
+		if _, exists := s.byNickname[strings.ToLower(tomb.Nickname)]; !exists {
+			s.tombstones[strings.ToLower(tomb.Nickname)] = tomb
+		}
+	}
+
+	if hashed > 0 || state.KeyCheck != s.KeyCheck() {
+		if err := backend.compact(s.snapshot()); err != nil {
+			return nil, err
+		}
+	}
+	if hashed > 0 {
+		log.Printf("Replaced %d plaintext tokens with hashes. Old backups still contain plaintext tokens!\n", hashed)
+	}
+	return s, nil
 }
 
-// NewStorage creates a new storage instance
-func NewStorage(filename string) *Storage {
-	return &Storage{
-		filename: filename,
+// OpenStorage opens record storage of the given kind ("tsv" or "journal").
+// When journal is requested but only the old TSV file exists, records are
+// migrated once and the TSV file is renamed to *.migrated. With custom
+// filename the TSV file is that file itself, converted in place.
+// Token key is read from keyFile, see LoadTokenKey.
+// Deleted nicknames stay reserved for previous owners during cooldown
+func OpenStorage(kind, filename, keyFile string, cooldown time.Duration) (RecordStore, error) {
+	var backend recordBackend
+	switch kind {
+	case "", "tsv":
+		if filename == "" {
+			filename = DefaultTSVFile
+		}
+		if err := checkNotMigrated(filename); err != nil {
+			return nil, err
+		}
+		backend = &tsvBackend{filename: filename}
+
+	case "journal":
+		tsvFile := filename
+		if filename == "" {
+			filename = DefaultJournalFile
+			tsvFile = DefaultTSVFile
+		}
+		journal := &journalBackend{filename: filename}
+		if err := migrateTSVToJournal(tsvFile, journal); err != nil {
+			return nil, err
+		}
+		backend = journal
+
+	default:
+		return nil, fmt.Errorf("unknown storage type `%s`", kind)
+	}
+
+	state, err := backend.load()
+	if err != nil {
+		return nil, err
 	}
+	hashKey, err := LoadTokenKey(keyFile, state.hasHashes())
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(backend, state, hashKey, cooldown)
+}
+
+// checkNotMigrated refuses to use filename as TSV storage after it was
+// migrated to journal, it would look empty and be overwritten
+func checkNotMigrated(filename string) error {
+	info, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(filename + ".migrated"); err == nil {
+			return fmt.Errorf("%s was migrated to journal, set Storage = \"journal\" or restore the file from %s.migrated", filename, filename)
+		}
+		return nil
+	}
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	isJournal, err := isJournalFile(filename)
+	if err == nil && isJournal {
+		return fmt.Errorf("%s is a journal, set Storage = \"journal\"", filename)
+	}
+	return err
+}
+
+// migrateTSVToJournal imports records from old TSV file if journal doesn't exist yet.
+// If both have the same name, the file is migrated unless it's a journal already
+func migrateTSVToJournal(tsvFile string, backend *journalBackend) error {
+	inPlace := tsvFile == backend.filename
+	if !inPlace {
+		if _, err := os.Stat(backend.filename); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if _, err := os.Stat(tsvFile); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if inPlace {
+		if isJournal, err := isJournalFile(tsvFile); err != nil || isJournal {
+			return err
+		}
+	}
+
+	old := &tsvBackend{filename: tsvFile}
+	state, err := old.load()
+	if err != nil {
+		return err
+	}
+	if state.Skipped > 0 {
+		return fmt.Errorf("%d lines of %s can't be read, fix or remove them before migration", state.Skipped, tsvFile)
+	}
+	if inPlace {
+		// Journal replaces the file, so the original is moved away first
+		if err := os.Rename(tsvFile, tsvFile+".migrated"); err != nil {
+			return err
+		}
+		if err := backend.compact(state); err != nil {
+			os.Rename(tsvFile+".migrated", tsvFile)
+			return err
+		}
+	} else {
+		if err := backend.compact(state); err != nil {
+			return err
+		}
+		if err := os.Rename(tsvFile, tsvFile+".migrated"); err != nil {
+			return err
+		}
+	}
+	log.Printf("Migrated %d records from %s to %s\n", len(state.Records), tsvFile, backend.filename)
+	return nil
 }
 
 var (
 	ErrNicknameExists   = errors.New("nickname already exists")
 	ErrNicknameNotFound = errors.New("nickname not found")
 	ErrAccessDenied     = errors.New("attempt to delete a nickname that does not belong to")
+	ErrRecordNotFound   = errors.New("record not found")
+	ErrKeyNotFound      = errors.New("access key not found")
+	ErrLastKey          = errors.New("can't revoke the last access key")
+	ErrTooManyKeys      = errors.New("too many access keys")
+	ErrBadKeyLabel      = errors.New("bad access key label")
+	ErrBadGuestPass     = errors.New("guest pass must be limited")
+	ErrGuestRecord      = errors.New("guest nickname can only have guest passes")
+	ErrNicknameReserved = errors.New("nickname is reserved for previous owner")
+	ErrOtherTokenKey    = errors.New("addresses were hashed with another token key, check TokenKeyFile")
 )
 
-// generateUniqueToken creates a random 15-character token and ensures it's unique
-func (s *Storage) generateUniqueToken() (string, error) {
-	records, err := s.readRecords()
+const GuestKeyLabel = "guest"
+
+const DefaultNicknameCooldown = time.Hour * 24 * 30
+
+// isValidKeyLabel allows short labels that need no escaping in any storage format
+func isValidKeyLabel(label string) bool {
+	if len(label) < 1 || len(label) > 16 {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenString reports whether s has only characters of generated tokens
+func isTokenString(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks record from outside, e.g. a hand-edited import, so it
+// can't break storage files or be taken for a bot command
+func (r *StorageRecord) validate() error {
+	if !isValidMinecraftUsername(r.Nickname) {
+		return fmt.Errorf("bad nickname `%s`", r.Nickname)
+	}
+	if r.LastIP != "" && net.ParseIP(r.LastIP) == nil {
+		return fmt.Errorf("bad last IP `%s`", r.LastIP)
+	}
+	if len(r.Keys) == 0 {
+		return errors.New("record has no keys")
+	}
+	ids := make(map[int]bool)
+	for _, key := range r.Keys {
+		if key.ID <= 0 || ids[key.ID] {
+			return fmt.Errorf("bad or repeated key ID %d", key.ID)
+		}
+		ids[key.ID] = true
+		if !isValidKeyLabel(key.Label) {
+			return fmt.Errorf("key %d: %w", key.ID, ErrBadKeyLabel)
+		}
+		if key.Token != "" {
+			if !isTokenString(key.Token) {
+				return fmt.Errorf("key %d: bad token", key.ID)
+			}
+			continue
+		}
+		if hash, err := hex.DecodeString(key.Hash); err != nil || len(hash) != sha256.Size || key.Hash != strings.ToLower(key.Hash) {
+			return fmt.Errorf("key %d: bad hash", key.ID)
+		}
+		if len(key.Hint) > tokenHintLen || !isTokenString(key.Hint) {
+			return fmt.Errorf("key %d: bad hint", key.ID)
+		}
+	}
+	return nil
+}
+
+// insert adds record to in-memory indexes. Caller must hold write lock
+func (s *Storage) insert(r *StorageRecord) {
+	s.records = append(s.records, r)
+	s.index(r)
+}
+
+// remove deletes record from in-memory indexes. Caller must hold write lock
+func (s *Storage) remove(r *StorageRecord) {
+	for i, existing := range s.records {
+		if existing == r {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			break
+		}
+	}
+	s.unindex(r)
+}
+
+func (s *Storage) index(r *StorageRecord) {
+	for _, key := range r.Keys {
+		prefix := hashPrefix(key.Hash)
+		s.byHash[prefix] = append(s.byHash[prefix], r)
+	}
+	s.byNickname[strings.ToLower(r.Nickname)] = r
+}
+
+func (s *Storage) unindex(r *StorageRecord) {
+	for _, key := range r.Keys {
+		prefix := hashPrefix(key.Hash)
+		bucket := s.byHash[prefix]
+		for i, existing := range bucket {
+			if existing == r {
+				bucket = append(bucket[:i], bucket[i+1:]...)
+				break
+			}
+		}
+		if len(bucket) == 0 {
+			delete(s.byHash, prefix)
+		} else {
+			s.byHash[prefix] = bucket
+		}
+	}
+	delete(s.byNickname, strings.ToLower(r.Nickname))
+}
+
+// lookup finds record and index of its key with given token hash. Caller must hold lock
+func (s *Storage) lookup(hash string) (*StorageRecord, int) {
+	for _, r := range s.byHash[hashPrefix(hash)] {
+		for i := range r.Keys {
+			if subtle.ConstantTimeCompare([]byte(r.Keys[i].Hash), []byte(hash)) == 1 {
+				return r, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// hashToken returns hex encoded keyed hash of token
+func (s *Storage) hashToken(token string) string {
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// KeyCheck returns hash of a fixed string, which tells files hashed with another key.
+// It can't be a token, those have no spaces
+func (s *Storage) KeyCheck() string {
+	return hashPrefix(s.hashToken("token key check"))
+}
+
+func hashPrefix(hash string) string {
+	if len(hash) < tokenHashPrefixLen {
+		return hash
+	}
+	return hash[:tokenHashPrefixLen]
+}
+
+func tokenHint(token string) string {
+	if len(token) < tokenHintLen {
+		return token
+	}
+	return token[:tokenHintLen]
+}
+
+// LoadTokenKey reads secret key for token hashes, creating a new one if file doesn't exist
+// and storage has no hashes yet. Losing this file makes every stored token invalid,
+// so with mustExist the missing file is an error
+func LoadTokenKey(filename string, mustExist bool) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("bad token key in %s", filename)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if mustExist {
+		return nil, fmt.Errorf("token key %s not found, but storage has addresses hashed with it. "+
+			"Restore the file or set TokenKeyFile to it, a new key would make every address invalid", filename)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		return nil, err
+	}
+	log.Printf("Created new token key in %s, keep it out of data backups\n", filename)
+	return key, f.Sync()
+}
+
+// commit replaces record with updated version and saves it.
+// On save failure the old version is restored. Caller must hold write lock
+func (s *Storage) commit(record *StorageRecord, updated StorageRecord) error {
+	backup := *record
+	s.unindex(record)
+	*record = updated
+	s.index(record)
+	if err := s.backend.put(record.clone(), s.snapshot); err != nil {
+		s.unindex(record)
+		*record = backup
+		s.index(record)
+		return err
+	}
+	s.revoke(&backup, record)
+	return nil
+}
+
+// revoke reports keys of old record version that don't work in updated one,
+// updated is nil if record was deleted. Caller must hold lock
+func (s *Storage) revoke(old, updated *StorageRecord) {
+	if s.revoked == nil {
+		return
+	}
+	var keyIDs []int
+	for _, key := range old.Keys {
+		if updated == nil || updated.Disabled || updated.ID != old.ID {
+			keyIDs = append(keyIDs, key.ID)
+		} else if newKey, ok := updated.Key(key.ID); !ok || newKey.Hash != key.Hash {
+			keyIDs = append(keyIDs, key.ID)
+		}
+	}
+	if len(keyIDs) > 0 {
+		s.revoked(old.Nickname, keyIDs)
 	}
+}
+
+// OnRevoke sets fn to be called when access keys stop working
+func (s *Storage) OnRevoke(fn func(nickname string, keyIDs []int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revoked = fn
+}
 
-	// Create a map of existing tokens for faster lookup
-	existingTokens := make(map[string]struct{})
-	for _, r := range records {
-		existingTokens[r.Token] = struct{}{}
+// owned returns record of nickname if it belongs to id. Caller must hold lock
+func (s *Storage) owned(nickname string, id int64) (*StorageRecord, error) {
+	record, ok := s.byNickname[strings.ToLower(nickname)]
+	if !ok {
+		return nil, ErrNicknameNotFound
 	}
+	if record.ID != id {
+		return nil, ErrAccessDenied
+	}
+	return record, nil
+}
 
+// snapshot returns copy of all records and active tombstones. Caller must hold lock
+func (s *Storage) snapshot() storageState {
+	state := storageState{Records: make([]StorageRecord, 0, len(s.records)), KeyCheck: s.KeyCheck()}
+	for _, r := range s.records {
+		state.Records = append(state.Records, r.clone())
+	}
+	for _, tomb := range s.tombstones {
+		if s.reserves(tomb, time.Now()) {
+			state.Tombstones = append(state.Tombstones, *tomb)
+		}
+	}
+	sort.Slice(state.Tombstones, func(i, j int) bool {
+		return state.Tombstones[i].DeletedAt.Before(state.Tombstones[j].DeletedAt)
+	})
+	return state
+}
+
+// reserves reports whether tombstone is still within cooldown
+func (s *Storage) reserves(tomb *Tombstone, now time.Time) bool {
+	return now.Sub(tomb.DeletedAt) < s.cooldown
+}
+
+// checkReserved returns ErrNicknameReserved if nickname was deleted recently
+// by someone other than id. Caller must hold lock
+func (s *Storage) checkReserved(nickname string, id int64) error {
+	tomb, ok := s.tombstones[strings.ToLower(nickname)]
+	if ok && tomb.PrevOwner != id && s.reserves(tomb, time.Now()) {
+		return ErrNicknameReserved
+	}
+	return nil
+}
+
+// create inserts a new record and saves it, dropping tombstone of its nickname.
+// Caller must hold write lock
+func (s *Storage) create(record *StorageRecord) error {
+	lower := strings.ToLower(record.Nickname)
+	tomb, hadTomb := s.tombstones[lower]
+	delete(s.tombstones, lower)
+	s.insert(record)
+	if err := s.backend.put(record.clone(), s.snapshot); err != nil {
+		s.remove(record)
+		if hadTomb {
+			s.tombstones[lower] = tomb
+		}
+		return err
+	}
+	return nil
+}
+
+// bury removes record and saves it, leaving a tombstone if cooldown is set.
+// Caller must hold write lock
+func (s *Storage) bury(record *StorageRecord) error {
+	var tomb *Tombstone
+	lower := strings.ToLower(record.Nickname)
+	if s.cooldown > 0 {
+		tomb = &Tombstone{
+			Nickname:      record.Nickname,
+			PrevOwner:     record.ID,
+			PrevOwnerName: record.TgName,
+			DeletedAt:     time.Now(),
+		}
+		s.tombstones[lower] = tomb
+	}
+	s.remove(record)
+	if err := s.backend.delete(record.Nickname, tomb, s.snapshot); err != nil {
+		delete(s.tombstones, lower)
+		s.insert(record)
+		return err
+	}
+	s.revoke(record, nil)
+	return nil
+}
+
+// newAccessKey creates a key with random token, ensuring it's unique.
+// Returned key has plaintext Token set, it must be cleared before storing.
+// Caller must hold lock
+func (s *Storage) newAccessKey(keyID int, label string) (AccessKey, error) {
 	// Try to generate unique token with maximum attempts
 	maxAttempts := 100
 	for i := 0; i < maxAttempts; i++ {
 		token := generateToken()
-		if _, exists := existingTokens[token]; !exists {
-			return token, nil
+		hash := s.hashToken(token)
+		if r, _ := s.lookup(hash); r == nil {
+			return AccessKey{
+				ID:        keyID,
+				Label:     label,
+				Hash:      hash,
+				Hint:      tokenHint(token),
+				Token:     token,
+				CreatedAt: time.Now(),
+			}, nil
 		}
 	}
 
-	return "", errors.New("failed to generate unique token after maximum attempts")
+	return AccessKey{}, errors.New("failed to generate unique token after maximum attempts")
+}
+
+// withToken returns copy of record with plaintext token of a fresh key
+func withToken(r *StorageRecord, key AccessKey) (*StorageRecord, *AccessKey) {
+	result := r.clone()
+	for i := range result.Keys {
+		if result.Keys[i].ID == key.ID {
+			result.Keys[i].Token = key.Token
+			return &result, &result.Keys[i]
+		}
+	}
+	return &result, nil
 }
 
-// generateToken creates a random 15-character token
+// generateToken creates a random 20-character token
 func generateToken() string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	token := make([]byte, 20)
@@ -79,160 +776,448 @@ func (s *Storage) AddRecord(nickname, tgname string, id int64) (*StorageRecord,
 	defer s.mu.Unlock()
 
 	// Check if nickname already exists
-	records, err := s.readRecords()
-	if err != nil {
-		return nil, err
+	if _, exists := s.byNickname[strings.ToLower(nickname)]; exists {
+		return nil, ErrNicknameExists
 	}
-
-	for _, r := range records {
-		if strings.EqualFold(r.Nickname, nickname) {
-			return nil, ErrNicknameExists
-		}
+	if err := s.checkReserved(nickname, id); err != nil {
+		return nil, err
 	}
 
-	token, err := s.generateUniqueToken()
+	key, err := s.newAccessKey(1, DefaultKeyLabel)
 	if err != nil {
 		return nil, err
 	}
+	stored := key
+	stored.Token = ""
 
 	// Create new record
 	record := &StorageRecord{
-		Token:    token,
-		Nickname: nickname,
-		ID:       id,
-		TgName:   strings.TrimSpace(tgname),
+		Version:   StorageRecordVersion,
+		Keys:      []AccessKey{stored},
+		Nickname:  nickname,
+		ID:        id,
+		TgName:    strings.TrimSpace(tgname),
+		CreatedAt: key.CreatedAt,
 	}
 
-	// Append to file
-	f, err := os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	if err := s.create(record); err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	_, err = fmt.Fprintf(f, "%s\t%s\t%d\t%s\n", record.Token, record.Nickname, record.ID, record.TgName)
-	if err != nil {
-		return nil, err
+	result, _ := withToken(record, key)
+	return result, nil
+}
+
+// FindByToken searches for a record by token of any of its keys
+func (s *Storage) FindByToken(token string) (*StorageRecord, *AccessKey, error) {
+	hash := s.hashToken(token)
+
+	s.mu.RLock()
+	r, i := s.lookup(hash)
+	if r == nil {
+		s.mu.RUnlock()
+		return nil, nil, ErrRecordNotFound
 	}
+	result := r.clone()
+	s.mu.RUnlock()
 
-	return record, nil
+	return &result, &result.Keys[i], nil
 }
 
-// FindByToken searches for a record by token
-func (s *Storage) FindByToken(token string) (*StorageRecord, error) {
+// FindByNickname searches for a record by nickname, case-insensitive
+func (s *Storage) FindByNickname(nickname string) (*StorageRecord, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	records, err := s.readRecords()
-	if err != nil {
-		return nil, err
+	r, ok := s.byNickname[strings.ToLower(nickname)]
+	if !ok {
+		return nil, ErrNicknameNotFound
 	}
+	result := r.clone()
+	return &result, nil
+}
 
-	for _, r := range records {
-		if r.Token == token {
-			return &r, nil
+// FindByTgID returns all records with matching telegram ID
+func (s *Storage) FindByTgID(id int64) ([]StorageRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []StorageRecord
+	for _, r := range s.records {
+		if r.ID == id {
+			result = append(result, r.clone())
 		}
 	}
 
-	return nil, errors.New("record not found")
+	return result, nil
 }
 
-// FindByTgID returns all records with matching telegram ID
-func (s *Storage) FindByTgID(id int64) ([]StorageRecord, error) {
+// ForEach calls fn for a copy of every record until fn returns false
+func (s *Storage) ForEach(fn func(r StorageRecord) bool) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	records := s.snapshot()
+	s.mu.RUnlock()
+
+	for _, r := range records.Records {
+		if !fn(r) {
+			return
+		}
+	}
+}
+
+// UpdateRecord applies update to a copy of the record and saves the result
+func (s *Storage) UpdateRecord(nickname string, update func(r *StorageRecord) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.byNickname[strings.ToLower(nickname)]
+	if !ok {
+		return ErrNicknameNotFound
+	}
+
+	updated := record.clone()
+	if err := update(&updated); err != nil {
+		return err
+	}
+	if updated.Nickname != record.Nickname {
+		return errors.New("nickname can't be changed")
+	}
+	for i := range updated.Keys {
+		key := &updated.Keys[i]
+		if key.Token != "" {
+			key.Hash = s.hashToken(key.Token)
+			key.Hint = tokenHint(key.Token)
+			key.Token = ""
+		}
+		if owner, _ := s.lookup(key.Hash); owner != nil && owner != record {
+			return errors.New("token already in use")
+		}
+	}
+
+	return s.commit(record, updated)
+}
 
-	records, err := s.readRecords()
+// ImportRecord adds record as is, e.g. from a backup. Plaintext tokens of
+// older formats are hashed. Existing record is replaced only if replace is set
+func (s *Storage) ImportRecord(r StorageRecord, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.upgrade()
+	if err := r.validate(); err != nil {
+		return err
+	}
+	existing, exists := s.byNickname[strings.ToLower(r.Nickname)]
+	if exists && !replace {
+		return ErrNicknameExists
+	}
+	for i := range r.Keys {
+		key := &r.Keys[i]
+		if key.Token != "" {
+			key.Hash = s.hashToken(key.Token)
+			key.Hint = tokenHint(key.Token)
+			key.Token = ""
+		}
+		if owner, _ := s.lookup(key.Hash); owner != nil && owner != existing {
+			return errors.New("token already in use")
+		}
+	}
+
+	if exists {
+		r.Nickname = existing.Nickname
+		return s.commit(existing, r)
+	}
+	return s.create(&r)
+}
+
+// AddKey creates a new access key with label for the nickname
+func (s *Storage) AddKey(nickname string, id int64, label string) (*StorageRecord, *AccessKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !isValidKeyLabel(label) {
+		return nil, nil, ErrBadKeyLabel
+	}
+	record, err := s.owned(nickname, id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	// Permanent key would outlive the pass and escape the guest quota
+	if record.Guest {
+		return nil, nil, ErrGuestRecord
+	}
+	if len(record.Keys) >= MaxKeysPerRecord {
+		return nil, nil, ErrTooManyKeys
 	}
 
-	var result []StorageRecord
-	for _, r := range records {
-		if r.ID == id {
-			result = append(result, r)
+	keyID := 1
+	for _, key := range record.Keys {
+		if key.ID >= keyID {
+			keyID = key.ID + 1
 		}
 	}
 
-	return result, nil
+	key, err := s.newAccessKey(keyID, label)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored := key
+	stored.Token = ""
+
+	updated := record.clone()
+	updated.Keys = append(updated.Keys, stored)
+	if err := s.commit(record, updated); err != nil {
+		return nil, nil, err
+	}
+
+	result, resultKey := withToken(record, key)
+	return result, resultKey, nil
 }
 
-// DeleteByUsername removes a record by nickname
-func (s *Storage) DeleteByNickname(nickname string, id int64) error {
+// RevokeKey removes a single access key of the nickname
+func (s *Storage) RevokeKey(nickname string, id int64, keyID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	records, err := s.readRecords()
+	record, err := s.owned(nickname, id)
 	if err != nil {
 		return err
 	}
+	if _, ok := record.Key(keyID); !ok {
+		return ErrKeyNotFound
+	}
+	if len(record.Keys) == 1 {
+		return ErrLastKey
+	}
 
-	var newRecords []StorageRecord
-	found := false
-	for _, r := range records {
-		if r.Nickname != nickname {
-			newRecords = append(newRecords, r)
-		} else {
-			if r.ID != id {
-				return ErrAccessDenied
-			}
-			found = true
+	updated := record.clone()
+	updated.Keys = updated.Keys[:0]
+	for _, key := range record.Keys {
+		if key.ID != keyID {
+			updated.Keys = append(updated.Keys, key)
 		}
 	}
+	return s.commit(record, updated)
+}
 
-	if !found {
-		return ErrNicknameNotFound
+// RotateToken generates a new token for the access key, keeping everything else
+func (s *Storage) RotateToken(nickname string, id int64, keyID int) (*StorageRecord, *AccessKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.owned(nickname, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	updated := record.clone()
+	key, ok := updated.Key(keyID)
+	if !ok {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	fresh, err := s.newAccessKey(key.ID, key.Label)
+	if err != nil {
+		return nil, nil, err
+	}
+	key.Hash = fresh.Hash
+	key.Hint = fresh.Hint
+	key.CreatedAt = fresh.CreatedAt
+	if err := s.commit(record, updated); err != nil {
+		return nil, nil, err
 	}
 
-	// Rewrite the entire file
-	return s.writeRecords(newRecords)
+	result, resultKey := withToken(record, fresh)
+	return result, resultKey, nil
 }
 
-// readRecords reads all records from file
-func (s *Storage) readRecords() ([]StorageRecord, error) {
-	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_RDONLY, 0644)
+// IssueGuestPass creates guest key for nickname, registering it if needed
+func (s *Storage) IssueGuestPass(nickname, tgname string, id int64, pass GuestPass, anyOwner bool) (*StorageRecord, *AccessKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pass.Duration <= 0 && pass.MaxUses <= 0 {
+		return nil, nil, ErrBadGuestPass
+	}
+
+	record, exists := s.byNickname[strings.ToLower(nickname)]
+	if exists && record.ID != id && !anyOwner {
+		return nil, nil, ErrAccessDenied
+	}
+	if exists && len(record.Keys) >= MaxKeysPerRecord {
+		return nil, nil, ErrTooManyKeys
+	}
+	if !exists && !anyOwner {
+		if err := s.checkReserved(nickname, id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	keyID := 1
+	if exists {
+		for _, key := range record.Keys {
+			if key.ID >= keyID {
+				keyID = key.ID + 1
+			}
+		}
+	}
+
+	key, err := s.newAccessKey(keyID, GuestKeyLabel)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
+	if pass.Duration > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(pass.Duration)
+	}
+	key.MaxUses = pass.MaxUses
+	key.IssuedBy = id
+	stored := key
+	stored.Token = ""
+
+	if exists {
+		updated := record.clone()
+		updated.Keys = append(updated.Keys, stored)
+		if err := s.commit(record, updated); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		record = &StorageRecord{
+			Version:   StorageRecordVersion,
+			Keys:      []AccessKey{stored},
+			Nickname:  nickname,
+			ID:        id,
+			TgName:    strings.TrimSpace(tgname),
+			CreatedAt: key.CreatedAt,
+			Guest:     true,
+		}
+		if err := s.create(record); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	result, resultKey := withToken(record, key)
+	return result, resultKey, nil
+}
+
+// RemoveExpired deletes expired guest keys. Returns number of removed keys
+func (s *Storage) RemoveExpired(now time.Time, inUse func(nickname string, keyID int) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	var records []StorageRecord
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		fields := strings.SplitN(scanner.Text(), "\t", 4)
-		if len(fields) != 4 {
+	removed := 0
+	for _, record := range append([]*StorageRecord(nil), s.records...) {
+		updated := record.clone()
+		updated.Keys = updated.Keys[:0]
+		for _, key := range record.Keys {
+			if !key.Expired(now) || !key.TimedOut(now) && inUse(record.Nickname, key.ID) {
+				updated.Keys = append(updated.Keys, key)
+			}
+		}
+		expired := len(record.Keys) - len(updated.Keys)
+		if expired == 0 {
+			continue
+		}
+
+		if len(updated.Keys) == 0 && record.Guest {
+			if err := s.bury(record); err != nil {
+				return removed, err
+			}
+		} else if len(updated.Keys) > 0 {
+			if err := s.commit(record, updated); err != nil {
+				return removed, err
+			}
+		} else {
+			// Regular record must keep at least one key, expired one just doesn't work
 			continue
 		}
+		removed += expired
+	}
+	return removed, nil
+}
 
-		var id int64
-		fmt.Sscanf(fields[2], "%d", &id)
+// DeleteByUsername removes a record by nickname
+func (s *Storage) DeleteByNickname(nickname string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		record := StorageRecord{
-			Token:    fields[0],
-			Nickname: fields[1],
-			ID:       id,
-			TgName:   fields[3],
+	var record *StorageRecord
+	for _, r := range s.records {
+		if r.Nickname == nickname {
+			record = r
+			break
 		}
-		records = append(records, record)
+	}
+	if record == nil {
+		return ErrNicknameNotFound
+	}
+	if record.ID != id {
+		return ErrAccessDenied
 	}
 
-	return records, scanner.Err()
+	return s.bury(record)
 }
 
-// writeRecords writes all records to file
-func (s *Storage) writeRecords(records []StorageRecord) error {
-	f, err := os.Create(s.filename)
-	if err != nil {
+// FindTombstone returns reservation of a recently deleted nickname
+func (s *Storage) FindTombstone(nickname string) (*Tombstone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tomb, ok := s.tombstones[strings.ToLower(nickname)]
+	if !ok || !s.reserves(tomb, time.Now()) {
+		return nil, ErrNicknameNotFound
+	}
+	result := *tomb
+	return &result, nil
+}
+
+// ReleaseNickname lets anyone register a recently deleted nickname
+func (s *Storage) ReleaseNickname(nickname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lower := strings.ToLower(nickname)
+	tomb, ok := s.tombstones[lower]
+	if !ok {
+		return ErrNicknameNotFound
+	}
+	delete(s.tombstones, lower)
+	if err := s.backend.release(tomb.Nickname, s.snapshot); err != nil {
+		s.tombstones[lower] = tomb
 		return err
 	}
-	defer f.Close()
+	return nil
+}
 
-	for _, r := range records {
-		_, err := fmt.Fprintf(f, "%s\t%s\t%d\t%s\n", r.Token, r.Nickname, r.ID, r.TgName)
-		if err != nil {
-			return err
-		}
+///////////////////////////////////////////////////////////////////////////////
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over filename, so a crash never leaves a truncated file behind
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name()) // No-op after successful rename
 
-	return nil
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultJournalFile = "data.journal"
+	// Journal is compacted when it has this many entries more than live records
+	journalCompactSlack = 256
+)
+
+// journalEntry is a single line of the journal file
+type journalEntry struct {
+	Op        string         `json:"op"` // "put", "del", "tomb", "release" or "key"
+	Record    *StorageRecord `json:"record,omitempty"`
+	Nickname  string         `json:"nickname,omitempty"`
+	Tombstone *Tombstone     `json:"tombstone,omitempty"` // Left by "del", or kept by "tomb" after compaction
+	KeyCheck  string         `json:"key_check,omitempty"` // Written by "key" first on compaction
+}
+
+// journalBackend stores records as an append-only log of JSON lines.
+// Every change is a single appended line, so strings are escaped by JSON
+// and nothing has to be rewritten. Once the log grows too long compared to
+// the number of live records it is rewritten as a snapshot
+type journalBackend struct {
+	filename string
+	mu       sync.Mutex
+	file     *os.File
+	entries  int // Lines in the file
+}
+
+func (j *journalBackend) load() (storageState, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var state storageState
+	f, err := os.OpenFile(j.filename, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return state, err
+	}
+	defer f.Close()
+
+	var order, tombOrder []string
+	records := make(map[string]StorageRecord)
+	tombstones := make(map[string]Tombstone)
+	j.entries = 0
+	needCompact := false
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if strings.TrimSpace(line) != "" {
+				// Crash in the middle of append, entry was never acknowledged
+				log.Printf("Journal %s: ignoring incomplete last entry\n", j.filename)
+				needCompact = true
+			}
+			break
+		}
+		if err != nil {
+			return state, err
+		}
+		j.entries++
+
+		var entry journalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			log.Printf("Journal %s: skipping bad entry %d: %v\n", j.filename, j.entries, err)
+			state.Skipped++
+			continue
+		}
+
+		switch entry.Op {
+		case "put":
+			if entry.Record == nil {
+				continue
+			}
+			key := strings.ToLower(entry.Record.Nickname)
+			if _, exists := records[key]; !exists {
+				order = append(order, key)
+			}
+			records[key] = *entry.Record
+			delete(tombstones, key)
+		case "del":
+			delete(records, strings.ToLower(entry.Nickname))
+		case "release":
+			delete(tombstones, strings.ToLower(entry.Nickname))
+		case "key":
+			state.KeyCheck = entry.KeyCheck
+		}
+		if entry.Tombstone != nil && (entry.Op == "del" || entry.Op == "tomb") {
+			key := strings.ToLower(entry.Tombstone.Nickname)
+			if _, exists := tombstones[key]; !exists {
+				tombOrder = append(tombOrder, key)
+			}
+			tombstones[key] = *entry.Tombstone
+		}
+	}
+
+	for _, key := range order {
+		if r, ok := records[key]; ok {
+			state.Records = append(state.Records, r)
+			delete(records, key) // Key repeats if nickname was registered again
+		}
+	}
+	for _, key := range tombOrder {
+		if tomb, ok := tombstones[key]; ok {
+			state.Tombstones = append(state.Tombstones, tomb)
+			delete(tombstones, key)
+		}
+	}
+
+	// Compaction would drop bad entries for good
+	if state.Skipped == 0 && (needCompact || j.entries > state.live()+journalCompactSlack) {
+		if err := j.compactLocked(state); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// isJournalFile reports whether file holds journal entries, not TSV lines.
+// Empty file counts as journal, there is nothing to migrate
+func isJournalFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return strings.HasPrefix(line, "{"), nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+// live returns number of journal entries needed to store state
+func (state storageState) live() int {
+	return len(state.Records) + len(state.Tombstones)
+}
+
+func (j *journalBackend) put(r StorageRecord, snapshot func() storageState) error {
+	return j.append(journalEntry{Op: "put", Record: &r}, snapshot)
+}
+
+func (j *journalBackend) delete(nickname string, tomb *Tombstone, snapshot func() storageState) error {
+	return j.append(journalEntry{Op: "del", Nickname: nickname, Tombstone: tomb}, snapshot)
+}
+
+func (j *journalBackend) release(nickname string, snapshot func() storageState) error {
+	return j.append(journalEntry{Op: "release", Nickname: nickname}, snapshot)
+}
+
+// append writes entry at the end of journal and compacts it when needed
+func (j *journalBackend) append(entry journalEntry, snapshot func() storageState) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		j.file, err = os.OpenFile(j.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries++
+
+	state := snapshot()
+	if j.entries > state.live()+journalCompactSlack {
+		if err := j.compactLocked(state); err != nil {
+			// Journal itself is fine, just longer than needed
+			log.Printf("Journal %s: compaction failed: %v\n", j.filename, err)
+		}
+	}
+	return nil
+}
+
+// compact replaces journal with a single put for every record
+// and a single tomb for every reserved nickname
+func (j *journalBackend) compact(state storageState) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.compactLocked(state)
+}
+
+func (j *journalBackend) compactLocked(state storageState) error {
+	err := writeFileAtomic(j.filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		if state.KeyCheck != "" {
+			if err := encoder.Encode(journalEntry{Op: "key", KeyCheck: state.KeyCheck}); err != nil {
+				return err
+			}
+		}
+		for i := range state.Records {
+			if err := encoder.Encode(journalEntry{Op: "put", Record: &state.Records[i]}); err != nil {
+				return err
+			}
+		}
+		for i := range state.Tombstones {
+			if err := encoder.Encode(journalEntry{Op: "tomb", Tombstone: &state.Tombstones[i]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Old handle points to the replaced file
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	j.entries = state.live()
+	return nil
+}
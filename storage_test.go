@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHashKey = []byte("0123456789abcdef0123456789abcdef")
+
+func testState() storageState {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	return storageState{
+		Records: []StorageRecord{
+			{
+				Version:   StorageRecordVersion,
+				Nickname:  "Steve",
+				ID:        42,
+				TgName:    "steve Tab\tand\nnewline \\ slash",
+				CreatedAt: at(1700000000),
+				LastSeen:  at(1700001000),
+				LastIP:    "10.0.0.1",
+				Sessions:  7,
+				Keys: []AccessKey{
+					{ID: 1, Label: "main", CreatedAt: at(1700000000), Hint: "abcd", Hash: "hash1"},
+					{ID: 2, Label: "phone", CreatedAt: at(1700000500), Hint: "efgh", Hash: "hash2"},
+				},
+			},
+			{
+				Version:   StorageRecordVersion,
+				Nickname:  "Guest_1",
+				ID:        43,
+				TgName:    "alex",
+				CreatedAt: at(1700002000),
+				Disabled:  true,
+				Guest:     true,
+				Keys: []AccessKey{
+					{ID: 1, Label: GuestKeyLabel, CreatedAt: at(1700002000), Hint: "ijkl", Hash: "hash3",
+						ExpiresAt: at(1700009000), MaxUses: 5, Uses: 2, IssuedBy: 42},
+				},
+			},
+		},
+		Tombstones: []Tombstone{
+			{Nickname: "Alex", PrevOwner: 44, PrevOwnerName: "old\towner", DeletedAt: at(1700003000)},
+		},
+		KeyCheck: "0123abcd",
+	}
+}
+
+func TestTSVRoundTrip(t *testing.T) {
+	want := testState()
+	var buf bytes.Buffer
+	if err := writeTSV(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 4 {
+		t.Fatalf("escaping failed, %d lines:\n%s", lines, buf.String())
+	}
+
+	got, err := readTSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch\ngot:  %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestTSVOldVersions(t *testing.T) {
+	data := strings.Join([]string{
+		"tok1\tNick1\t1\tname one",
+		"v2\ttok2\tNick2\t2\tname two\t1700000000\t1700000100\t10.0.0.2\t3\t1",
+		"v3\tNick3\t3\tname three\t1700000000\t0\t\t0\t0\t1:main:1700000000:tok3,2:pc:0:tok3b",
+		"v4\tNick4\t4\tname\\tfour\t1700000000\t0\t\t0\t0\t1:main:1700000000:hint:hash4",
+		"broken line",
+		"v4\tNoKeys\t5\tname\t0\t0\t\t0\t0\t",
+	}, "\n")
+	state, err := readTSV(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Records) != 4 || state.Skipped != 2 {
+		t.Fatalf("want 4 records and 2 skipped lines, got %d and %d: %+v", len(state.Records), state.Skipped, state.Records)
+	}
+
+	v1 := state.Records[0]
+	if v1.Version != 1 || v1.Token != "tok1" || v1.Nickname != "Nick1" || v1.ID != 1 || v1.TgName != "name one" {
+		t.Errorf("v1: %+v", v1)
+	}
+	v2 := state.Records[1]
+	if v2.Token != "tok2" || v2.ID != 2 || v2.LastIP != "10.0.0.2" || v2.Sessions != 3 || !v2.Disabled ||
+		!v2.CreatedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("v2: %+v", v2)
+	}
+	v3 := state.Records[2]
+	if len(v3.Keys) != 2 || v3.Keys[0].Token != "tok3" || v3.Keys[1].Label != "pc" || !v3.Keys[1].CreatedAt.IsZero() {
+		t.Errorf("v3: %+v", v3)
+	}
+	v4 := state.Records[3]
+	if v4.TgName != "name\tfour" || len(v4.Keys) != 1 || v4.Keys[0].Hint != "hint" || v4.Keys[0].Hash != "hash4" {
+		t.Errorf("v4: %+v", v4)
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data.journal")
+	want := testState()
+	want.KeyCheck = "" // Written on compaction only
+
+	backend := &journalBackend{filename: filename}
+	if _, err := backend.load(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func() storageState { return storageState{} }
+	for _, r := range want.Records {
+		if err := backend.put(r, snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleted, registered again and deleted for good
+	temp := StorageRecord{Version: StorageRecordVersion, Nickname: "Alex", ID: 44, Keys: []AccessKey{{ID: 1, Hash: "x"}}}
+	if err := backend.put(temp, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	tomb := want.Tombstones[0]
+	if err := backend.delete("alex", &tomb, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	released := Tombstone{Nickname: "Bob", PrevOwner: 45, DeletedAt: time.Unix(1700000000, 0)}
+	if err := backend.delete("Bob", &released, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.release("bob", snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := (&journalBackend{filename: filename}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameState(t, got, want)
+}
+
+func TestJournalCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data.journal")
+	want := testState()
+	backend := &journalBackend{filename: filename}
+	if _, err := backend.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := func() storageState { return want }
+	for i := 0; i < journalCompactSlack*2; i++ {
+		if err := backend.put(want.Records[0], snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.entries > want.live()+journalCompactSlack {
+		t.Fatalf("journal wasn't compacted: %d entries", backend.entries)
+	}
+	// Appends after compaction go to the new file
+	if err := backend.put(want.Records[1], snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := (&journalBackend{filename: filename}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameState(t, got, want)
+}
+
+func TestJournalIncompleteLastEntry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data.journal")
+	want := testState()
+	if err := (&journalBackend{filename: filename}).compact(want); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"del","nickname":"Ste`)
+	f.Close()
+
+	got, err := (&journalBackend{filename: filename}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameState(t, got, want)
+}
+
+func TestMigrateTSVToJournal(t *testing.T) {
+	dir := t.TempDir()
+	tsvFile := filepath.Join(dir, "data.txt")
+	journalFile := filepath.Join(dir, "data.journal")
+	writeTestTSV(t, tsvFile)
+
+	backend := &journalBackend{filename: journalFile}
+	if err := migrateTSVToJournal(tsvFile, backend); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tsvFile + ".migrated"); err != nil {
+		t.Fatal("TSV file wasn't renamed:", err)
+	}
+	s, err := NewStorage(backend, testHashKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMigrated(t, s)
+
+	// Journal exists, a new TSV file is ignored
+	writeTestTSV(t, tsvFile)
+	if err := migrateTSVToJournal(tsvFile, backend); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tsvFile); err != nil {
+		t.Fatal("TSV file was migrated twice")
+	}
+}
+
+func TestMigrateCustomStorageFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "players.db")
+	keyFile := filepath.Join(dir, "token.key")
+	writeTestTSV(t, filename)
+
+	store, err := OpenStorage("journal", filename, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMigrated(t, store)
+	if _, err := os.Stat(filename + ".migrated"); err != nil {
+		t.Fatal("original file wasn't kept:", err)
+	}
+	if isJournal, err := isJournalFile(filename); err != nil || !isJournal {
+		t.Fatal("file wasn't converted to journal", err)
+	}
+
+	// Opened again as journal, nothing is migrated
+	os.Remove(filename + ".migrated")
+	store, err = OpenStorage("journal", filename, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMigrated(t, store)
+	if _, err := os.Stat(filename + ".migrated"); err == nil {
+		t.Fatal("journal was migrated again")
+	}
+}
+
+func TestTSVDoesNotOverwriteJournal(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "token.key")
+	custom := filepath.Join(dir, "players.db")
+	writeTestTSV(t, custom)
+	if _, err := OpenStorage("journal", custom, keyFile, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	journal, _ := os.ReadFile(custom)
+
+	// Default names, data.txt is renamed after migration
+	tsvFile := filepath.Join(dir, "data.txt")
+	writeTestTSV(t, tsvFile)
+	if err := migrateTSVToJournal(tsvFile, &journalBackend{filename: filepath.Join(dir, "data.journal")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{custom, tsvFile} {
+		if _, err := OpenStorage("tsv", filename, keyFile, time.Hour); err == nil {
+			t.Errorf("%s: migrated storage opened as TSV", filename)
+		}
+	}
+	if data, _ := os.ReadFile(custom); !bytes.Equal(data, journal) {
+		t.Fatal("journal was overwritten")
+	}
+	if _, err := os.Stat(tsvFile); err == nil {
+		t.Fatal("empty TSV file was created")
+	}
+}
+
+func TestUnreadableLinesAreKept(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data.txt")
+	writeTestTSV(t, filename)
+	f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("v5\tbroken\n")
+	f.Close()
+	data, _ := os.ReadFile(filename)
+
+	if _, err := OpenStorage("tsv", filename, filepath.Join(dir, "token.key"), time.Hour); err == nil {
+		t.Fatal("file with unreadable lines opened")
+	}
+	if _, err := OpenStorage("journal", filename, filepath.Join(dir, "token.key"), time.Hour); err == nil {
+		t.Fatal("file with unreadable lines migrated")
+	}
+	if after, _ := os.ReadFile(filename); !bytes.Equal(after, data) {
+		t.Fatal("file was rewritten")
+	}
+}
+
+func TestTokenKeyIsNotRecreated(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data.txt")
+	keyFile := filepath.Join(dir, "token.key")
+	writeTestTSV(t, filename)
+
+	// Plaintext tokens only, the key is created to hash them
+	if _, err := OpenStorage("tsv", filename, keyFile, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStorage("tsv", filename, keyFile, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Rename(keyFile, keyFile+".lost")
+	if _, err := OpenStorage("tsv", filename, keyFile, time.Hour); err == nil {
+		t.Fatal("storage with hashes opened with a new key")
+	}
+	if _, err := os.Stat(keyFile); err == nil {
+		t.Fatal("new key was created")
+	}
+
+	os.Rename(keyFile+".lost", keyFile)
+	store, err := OpenStorage("tsv", filename, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMigrated(t, store)
+}
+
+func TestOtherTokenKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data.txt")
+	writeTestTSV(t, filename)
+	if _, err := NewStorage(&tsvBackend{filename: filename}, testHashKey, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	if _, err := NewStorage(&tsvBackend{filename: filename}, otherKey, time.Hour); err != ErrOtherTokenKey {
+		t.Fatal("opened with another key:", err)
+	}
+}
+
+func TestImportRecordValidation(t *testing.T) {
+	s, err := NewStorage(&tsvBackend{filename: filepath.Join(t.TempDir(), "data.txt")}, testHashKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.Repeat("ab", 32)
+	good := StorageRecord{Nickname: "Steve", ID: 1, LastIP: "10.0.0.1", Keys: []AccessKey{{ID: 1, Label: "main", Hint: "abcd", Hash: hash}}}
+	if err := s.ImportRecord(good, false); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := map[string]func(r *StorageRecord){
+		"command nickname": func(r *StorageRecord) { r.Nickname = "guest" },
+		"tab in nickname":  func(r *StorageRecord) { r.Nickname = "Al\tex" },
+		"newline in IP":    func(r *StorageRecord) { r.LastIP = "1.2.3.4\nv5" },
+		"no keys":          func(r *StorageRecord) { r.Keys = nil },
+		"repeated key ID":  func(r *StorageRecord) { r.Keys = append(r.Keys, r.Keys[0]) },
+		"bad label":        func(r *StorageRecord) { r.Keys[0].Label = "a:b" },
+		"short hash":       func(r *StorageRecord) { r.Keys[0].Hash = "abcd" },
+		"bad hint":         func(r *StorageRecord) { r.Keys[0].Hint = "a,b" },
+		"bad token":        func(r *StorageRecord) { r.Keys[0].Token = "tok.en" },
+	}
+	for name, change := range bad {
+		r := good.clone()
+		r.Nickname = "Alex"
+		change(&r)
+		if err := s.ImportRecord(r, false); err == nil {
+			t.Errorf("%s: imported", name)
+		}
+	}
+}
+
+func TestAddKeyRefusesGuestRecord(t *testing.T) {
+	s, err := NewStorage(&tsvBackend{filename: filepath.Join(t.TempDir(), "data.txt")}, testHashKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.IssueGuestPass("Friend", "friend", 1, GuestPass{Duration: time.Hour}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.AddKey("Friend", 1, "laptop"); err != ErrGuestRecord {
+		t.Fatal("permanent key added to guest nickname:", err)
+	}
+	if _, _, err := s.IssueGuestPass("Friend", "friend", 1, GuestPass{MaxUses: 1}, false); err != nil {
+		t.Fatal("guest pass refused:", err)
+	}
+}
+
+func writeTestTSV(t *testing.T, filename string) {
+	t.Helper()
+	data := "tok1\tNick1\t1\tname one\n" +
+		"v3\tNick3\t3\tname three\t1700000000\t0\t\t0\t0\t1:main:1700000000:tok3\n" +
+		"t1\tOld\t9\told owner\t" + strconv.FormatInt(time.Now().Unix(), 10) + "\n"
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertMigrated checks records of writeTestTSV, plaintext tokens must be found by hash
+func assertMigrated(t *testing.T, s RecordStore) {
+	t.Helper()
+	for token, nickname := range map[string]string{"tok1": "Nick1", "tok3": "Nick3"} {
+		r, _, err := s.FindByToken(token)
+		if err != nil || r.Nickname != nickname {
+			t.Fatalf("token %s: %v %+v", token, err, r)
+		}
+	}
+	if _, err := s.FindTombstone("old"); err != nil {
+		t.Fatal("tombstone lost:", err)
+	}
+}
+
+// assertSameState compares states read from JSON, where times lose their location
+func assertSameState(t *testing.T, got, want storageState) {
+	t.Helper()
+	if len(got.Records) != len(want.Records) || len(got.Tombstones) != len(want.Tombstones) {
+		t.Fatalf("got %d records and %d tombstones, want %d and %d",
+			len(got.Records), len(got.Tombstones), len(want.Records), len(want.Tombstones))
+	}
+	var gotTSV, wantTSV bytes.Buffer
+	writeTSV(&gotTSV, got)
+	writeTSV(&wantTSV, want)
+	if gotTSV.String() != wantTSV.String() {
+		t.Fatalf("state mismatch\ngot:\n%s\nwant:\n%s", gotTSV.String(), wantTSV.String())
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultTSVFile = "data.txt"
+
+// tsvBackend keeps records in the tab-separated `data.txt` format.
+// Original lines hold token, nickname, telegram ID and telegram name.
+// Since v2 lines start with version tag and have extra columns:
+// v2, token, nickname, ID, name, created, last seen, last IP, sessions, disabled.
+// v3 moves token to the last column holding comma-separated access keys,
+// each as `id:label:created:token`:
+// v3, nickname, ID, name, created, last seen, last IP, sessions, disabled, keys.
+// v4 has the same columns, but keys hold token hashes: `id:label:created:hint:hash`.
+// v5 adds guest column before keys, and guest pass limits to keys:
+// `id:label:created:hint:hash:expires:max uses:uses:issued by`.
+// All kinds are read, only v5 is written.
+// Reserved nicknames are kept after records as t1 lines:
+// t1, nickname, previous owner ID, previous owner name, deleted.
+// Every change rewrites the whole file
+type tsvBackend struct {
+	filename string
+}
+
+var (
+	tsvEscaper   = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	tsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+)
+
+func (t *tsvBackend) load() (storageState, error) {
+	f, err := os.OpenFile(t.filename, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return storageState{}, err
+	}
+	defer f.Close()
+	return readTSV(f)
+}
+
+// readTSV parses records and tombstones of any version, counting bad lines in Skipped
+func readTSV(r io.Reader) (storageState, error) {
+	var state storageState
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record StorageRecord
+		var ok bool
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		} else if check, isKeyCheck := strings.CutPrefix(scanner.Text(), "k1\t"); isKeyCheck {
+			state.KeyCheck = check
+			continue
+		} else if strings.HasPrefix(scanner.Text(), "t1\t") {
+			if tomb, ok := parseTSVTombstone(scanner.Text()); ok {
+				state.Tombstones = append(state.Tombstones, tomb)
+			} else {
+				state.Skipped++
+			}
+			continue
+		} else if strings.HasPrefix(scanner.Text(), "v5\t") {
+			record, ok = parseTSVRecordV3(scanner.Text(), 5)
+		} else if strings.HasPrefix(scanner.Text(), "v4\t") {
+			record, ok = parseTSVRecordV3(scanner.Text(), 4)
+		} else if strings.HasPrefix(scanner.Text(), "v3\t") {
+			record, ok = parseTSVRecordV3(scanner.Text(), 3)
+		} else if strings.HasPrefix(scanner.Text(), "v2\t") {
+			record, ok = parseTSVRecordV2(scanner.Text())
+		} else {
+			record, ok = parseTSVRecordV1(scanner.Text())
+		}
+		if ok {
+			state.Records = append(state.Records, record)
+		} else {
+			state.Skipped++
+		}
+	}
+
+	return state, scanner.Err()
+}
+
+func parseTSVTombstone(line string) (Tombstone, bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 5 {
+		return Tombstone{}, false
+	}
+
+	owner, _ := strconv.ParseInt(fields[2], 10, 64)
+	return Tombstone{
+		Nickname:      fields[1],
+		PrevOwner:     owner,
+		PrevOwnerName: tsvUnescaper.Replace(fields[3]),
+		DeletedAt:     parseTSVTime(fields[4]),
+	}, true
+}
+
+func parseTSVRecordV1(line string) (StorageRecord, bool) {
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) != 4 {
+		return StorageRecord{}, false
+	}
+
+	var id int64
+	fmt.Sscanf(fields[2], "%d", &id)
+
+	return StorageRecord{
+		Version:  1,
+		Token:    fields[0],
+		Nickname: fields[1],
+		ID:       id,
+		TgName:   tsvUnescaper.Replace(fields[3]),
+	}, true
+}
+
+func parseTSVRecordV2(line string) (StorageRecord, bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 10 {
+		return StorageRecord{}, false
+	}
+
+	id, _ := strconv.ParseInt(fields[3], 10, 64)
+	sessions, _ := strconv.Atoi(fields[8])
+	return StorageRecord{
+		Version:   2,
+		Token:     fields[1],
+		Nickname:  fields[2],
+		ID:        id,
+		TgName:    tsvUnescaper.Replace(fields[4]),
+		CreatedAt: parseTSVTime(fields[5]),
+		LastSeen:  parseTSVTime(fields[6]),
+		LastIP:    fields[7],
+		Sessions:  sessions,
+		Disabled:  fields[9] == "1",
+	}, true
+}
+
+// parseTSVRecordV3 parses v3 and later lines, keys are always the last column
+func parseTSVRecordV3(line string, version int) (StorageRecord, bool) {
+	fields := strings.Split(line, "\t")
+	columns, keyParts := 10, 4
+	switch version {
+	case 4:
+		keyParts = 5
+	case 5:
+		columns, keyParts = 11, 9
+	}
+	if len(fields) != columns {
+		return StorageRecord{}, false
+	}
+
+	id, _ := strconv.ParseInt(fields[2], 10, 64)
+	sessions, _ := strconv.Atoi(fields[7])
+	record := StorageRecord{
+		Version:   version,
+		Nickname:  fields[1],
+		ID:        id,
+		TgName:    tsvUnescaper.Replace(fields[3]),
+		CreatedAt: parseTSVTime(fields[4]),
+		LastSeen:  parseTSVTime(fields[5]),
+		LastIP:    fields[6],
+		Sessions:  sessions,
+		Disabled:  fields[8] == "1",
+		Guest:     version >= 5 && fields[9] == "1",
+	}
+	for _, encoded := range strings.Split(fields[columns-1], ",") {
+		parts := strings.Split(encoded, ":")
+		if len(parts) != keyParts {
+			continue
+		}
+		keyID, _ := strconv.Atoi(parts[0])
+		key := AccessKey{
+			ID:        keyID,
+			Label:     parts[1],
+			CreatedAt: parseTSVTime(parts[2]),
+		}
+		if version == 3 {
+			key.Token = parts[3]
+		} else {
+			key.Hint = parts[3]
+			key.Hash = parts[4]
+		}
+		if version >= 5 {
+			key.ExpiresAt = parseTSVTime(parts[5])
+			key.MaxUses, _ = strconv.Atoi(parts[6])
+			key.Uses, _ = strconv.Atoi(parts[7])
+			key.IssuedBy, _ = strconv.ParseInt(parts[8], 10, 64)
+		}
+		record.Keys = append(record.Keys, key)
+	}
+	return record, len(record.Keys) > 0
+}
+
+// parseTSVTime converts unix seconds to time, 0 means unknown
+func parseTSVTime(s string) time.Time {
+	sec, _ := strconv.ParseInt(s, 10, 64)
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func formatTSVBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func formatTSVTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func (t *tsvBackend) put(r StorageRecord, snapshot func() storageState) error {
+	return t.write(snapshot())
+}
+
+func (t *tsvBackend) delete(nickname string, tomb *Tombstone, snapshot func() storageState) error {
+	return t.write(snapshot())
+}
+
+func (t *tsvBackend) release(nickname string, snapshot func() storageState) error {
+	return t.write(snapshot())
+}
+
+func (t *tsvBackend) compact(state storageState) error {
+	return t.write(state)
+}
+
+// write replaces file content with all records and tombstones
+func (t *tsvBackend) write(state storageState) error {
+	return writeFileAtomic(t.filename, func(w io.Writer) error {
+		return writeTSV(w, state)
+	})
+}
+
+// writeTSV writes records as v5 lines followed by tombstones
+func writeTSV(w io.Writer, state storageState) error {
+	if state.KeyCheck != "" {
+		if _, err := fmt.Fprintf(w, "k1\t%s\n", state.KeyCheck); err != nil {
+			return err
+		}
+	}
+	for _, r := range state.Records {
+		keys := make([]string, 0, len(r.Keys))
+		for _, key := range r.Keys {
+			keys = append(keys, fmt.Sprintf("%d:%s:%s:%s:%s:%s:%d:%d:%d",
+				key.ID, key.Label, formatTSVTime(key.CreatedAt), key.Hint, key.Hash,
+				formatTSVTime(key.ExpiresAt), key.MaxUses, key.Uses, key.IssuedBy))
+		}
+		_, err := fmt.Fprintf(w, "v5\t%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			r.Nickname, r.ID, tsvEscaper.Replace(r.TgName),
+			formatTSVTime(r.CreatedAt), formatTSVTime(r.LastSeen), r.LastIP, r.Sessions,
+			formatTSVBool(r.Disabled), formatTSVBool(r.Guest), strings.Join(keys, ","))
+		if err != nil {
+			return err
+		}
+	}
+	for _, tomb := range state.Tombstones {
+		_, err := fmt.Fprintf(w, "t1\t%s\t%d\t%s\t%s\n",
+			tomb.Nickname, tomb.PrevOwner, tsvEscaper.Replace(tomb.PrevOwnerName), formatTSVTime(tomb.DeletedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
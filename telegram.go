@@ -4,37 +4,174 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/callbackquery"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/message"
-	mapset "github.com/deckarep/golang-set/v2"
 )
 
+const (
+	BotRetryInterval    = time.Second * 30
+	BotMaxRetryInterval = time.Minute * 5
+	DefaultWebhookPath  = "/telegram"
+)
+
+// Secret token format accepted by setWebhook
+var webhookSecretRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// `/a<id>` from approval requests, anything else starting with /a is another command or a nickname
+var approveCommandRe = regexp.MustCompile(`^/a(\d+)$`)
+
 var (
-	allowedIDs = mapset.NewSet[int64]()
-	bot        *gotgbot.Bot
+	// Set once the bot is connected, nil while Telegram is disabled or unreachable
+	bot       atomic.Pointer[gotgbot.Bot]
+	tgUpdater atomic.Pointer[ext.Updater]
 )
 
-func startTgBot() *ext.Updater {
-	var err error
-	bot, err = gotgbot.NewBot(cfg.BotToken, &gotgbot.BotOpts{
+// currentBot returns connected bot or nil
+func currentBot() *gotgbot.Bot {
+	return bot.Load()
+}
+
+// tgFrontend reaches users through the bot
+type tgFrontend struct{}
+
+func (tgFrontend) Send(id int64, msg string) error {
+	b := currentBot()
+	if b == nil {
+		return ErrFrontendOffline
+	}
+	_, err := b.SendMessage(id, msg, nil)
+	return err
+}
+
+// AskApproval sends request with approve/deny/block buttons
+func (tgFrontend) AskApproval(to int64, user TgUser, note string) error {
+	b := currentBot()
+	if b == nil {
+		return ErrFrontendOffline
+	}
+	msg := Msg(MsgApprovalRequest, user.Name, user.ID)
+	if note != "" {
+		msg += "\n" + note
+	}
+	_, err := b.SendMessage(to, msg, &gotgbot.SendMessageOpts{
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{
+			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+				{Text: Msg(MsgApproveButton), CallbackData: fmt.Sprintf("user:approve:%d", user.ID)},
+				{Text: Msg(MsgDenyButton), CallbackData: fmt.Sprintf("user:deny:%d", user.ID)},
+				{Text: Msg(MsgBlockButton), CallbackData: fmt.Sprintf("user:block:%d", user.ID)},
+			}},
+		},
+	})
+	return err
+}
+
+// approvalCallback handles approve/deny/block buttons, `user:<action>:<ID>`
+func approvalCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	cq := ctx.CallbackQuery
+	moderator := Sender{ID: cq.From.Id, Name: cq.From.Username, Frontend: tgFrontend{}}
+	action, idStr, _ := strings.Cut(strings.TrimPrefix(cq.Data, "user:"), ":")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "Bad ID"})
+		return err
+	}
+
+	var result string
+	switch action {
+	case "approve":
+		err = ApproveUser(moderator, id)
+		result = Msg(MsgUserApproved)
+		if err == ErrAlreadyApproved {
+			err = nil
+		} else if err != nil && err != ErrModeratorOnly {
+			result = Msg(MsgCantApprove) + "\n" + err.Error()
+			err = nil
+		}
+	case "deny":
+		err = DenyUser(moderator, id)
+		result = Msg(MsgUserDenied)
+	case "block":
+		err = BlockUser(moderator, id)
+		result = Msg(MsgUserBlocked)
+	default:
+		err = fmt.Errorf("unknown action `%s`", action)
+	}
+	if err != nil {
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: err.Error(), ShowAlert: true})
+		return err
+	}
+
+	// Drop buttons, so the request can't be decided twice by accident
+	if msg, ok := cq.Message.(gotgbot.Message); ok {
+		msg.EditText(b, msg.Text+"\n\n"+result, nil)
+	}
+	_, err = cq.Answer(b, nil)
+	return err
+}
+
+// startTgBot connects the bot in background, retrying until Telegram is reachable.
+// Without BotToken the proxy runs headless
+func startTgBot() {
+	if cfg.BotToken == "" {
+		log.Println("BotToken is not set, running without Telegram bot")
+		return
+	}
+
+	retry := BotRetryInterval
+	for !shutdown {
+		b, updater, err := connectTgBot()
+		if err == nil {
+			if shutdown {
+				updater.Stop()
+				return
+			}
+			tgUpdater.Store(updater)
+			bot.Store(b)
+			log.Printf("Telegram bot @%s started\n", b.Username)
+			updateStatusBoards()
+			return
+		}
+
+		log.Printf("Telegram bot unavailable, retrying in %v: %v\n", retry, err)
+		time.Sleep(retry)
+		retry = min(retry*2, BotMaxRetryInterval)
+	}
+}
+
+// stopTgBot stops receiving updates if the bot was started
+func stopTgBot() {
+	bot.Store(nil)
+	if updater := tgUpdater.Swap(nil); updater != nil {
+		updater.Stop()
+		log.Println("Bot stopped.")
+	}
+}
+
+func connectTgBot() (*gotgbot.Bot, *ext.Updater, error) {
+	b, err := gotgbot.NewBot(cfg.BotToken, &gotgbot.BotOpts{
 		BotClient: &gotgbot.BaseBotClient{
 			Client: http.Client{},
 			DefaultRequestOpts: &gotgbot.RequestOpts{
 				Timeout: gotgbot.DefaultTimeout,
+				APIURL:  cfg.BotAPIURL,
 			},
 		},
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
-	_, err = bot.SetMyCommands([]gotgbot.BotCommand{
+	_, err = b.SetMyCommands([]gotgbot.BotCommand{
 		{
 			Command:     "list",
 			Description: Msg(MsgListCmd),
@@ -43,13 +180,29 @@ func startTgBot() *ext.Updater {
 			Command:     "delete",
 			Description: Msg(MsgDeleteCmd),
 		},
+		{
+			Command:     "addkey",
+			Description: Msg(MsgAddKeyCmd),
+		},
+		{
+			Command:     "guest",
+			Description: Msg(MsgGuestCmd),
+		},
+		{
+			Command:     "regen",
+			Description: Msg(MsgRegenCmd),
+		},
+		{
+			Command:     "invite",
+			Description: Msg(MsgInviteCmd),
+		},
 		{
 			Command:     "online",
 			Description: Msg(MsgOnlineCmd),
 		},
 	}, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	// Create updater and dispatcher.
@@ -64,45 +217,129 @@ func startTgBot() *ext.Updater {
 	updater := ext.NewUpdater(dispatcher, nil)
 
 	dispatcher.AddHandler(handlers.NewMessage(message.Text, defaultHandler))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("user:"), approvalCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("find:"), findCallback))
+	dispatcher.AddHandler(handlers.NewCallback(callbackquery.Prefix("rec:"), recordCallback))
 
 	// Start receiving updates.
-	err = updater.StartPolling(bot, &ext.PollingOpts{
-		DropPendingUpdates: false,
-		GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
-			Timeout: 9,
-			RequestOpts: &gotgbot.RequestOpts{
-				Timeout: time.Second * 10,
+	if cfg.WebhookListen != "" {
+		err = startWebhook(b, updater)
+	} else {
+		// Telegram doesn't answer getUpdates while webhook is set, e.g. after switching from webhook mode
+		if _, err = b.DeleteWebhook(nil); err != nil {
+			return nil, nil, err
+		}
+		err = updater.StartPolling(b, &ext.PollingOpts{
+			DropPendingUpdates: false,
+			GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
+				Timeout: 9,
+				RequestOpts: &gotgbot.RequestOpts{
+					Timeout: time.Second * 10,
+				},
 			},
-		},
+		})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, updater, nil
+}
+
+// startWebhook serves updates on WebhookListen, e.g. behind a reverse proxy.
+// The updater rejects requests without matching secret header
+func startWebhook(b *gotgbot.Bot, updater *ext.Updater) error {
+	err := updater.StartWebhook(b, cfg.WebhookPath, ext.WebhookOpts{
+		ListenAddr:        cfg.WebhookListen,
+		ReadTimeout:       time.Second * 10,
+		ReadHeaderTimeout: time.Second * 10,
+		SecretToken:       cfg.WebhookSecret,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	log.Printf("Telegram webhook listening on %s%s\n", cfg.WebhookListen, cfg.WebhookPath)
 
-	return updater
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	_, err = b.SetWebhook(cfg.WebhookURL, &gotgbot.SetWebhookOpts{SecretToken: cfg.WebhookSecret})
+	if err != nil {
+		// Free the address for the next attempt
+		updater.Stop()
+	}
+	return err
+}
+
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// escapeMarkdown escapes special characters of legacy Markdown parse mode
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// cutCommand returns arguments of text if its first word is exactly command, like `/guest`,
+// optionally addressed to the bot as in groups. `/guestuser` is a nickname, not /guest
+func cutCommand(b *gotgbot.Bot, text, command string) (string, bool) {
+	name, args := text, ""
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		name, args = text[:i], text[i:]
+	}
+	name = strings.TrimSuffix(name, "@"+b.Username)
+	return args, name == command
+}
+
+// parseNickKey splits `<nickname>_<key ID>` from command like /regen_Nick_2.
+// Nicknames may contain underscores, so key ID is always the last part
+func parseNickKey(arg string) (string, int) {
+	i := strings.LastIndex(arg, "_")
+	if i < 0 {
+		return arg, 0
+	}
+	keyID, err := strconv.Atoi(arg[i+1:])
+	if err != nil {
+		return arg, 0
+	}
+	return arg[:i], keyID
+}
+
+// replyKeyError explains why access key operation failed
+func replyKeyError(b *gotgbot.Bot, ctx *ext.Context, err error) error {
+	switch err {
+	case ErrAccessDenied, ErrNicknameNotFound:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgNotYourNickname), nil)
+	case ErrKeyNotFound:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgKeyNotFound), nil)
+	case ErrLastKey:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgLastKey), nil)
+	case ErrBadKeyLabel:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgAddKeyUsage), nil)
+	case ErrTooManyKeys:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgTooManyKeys, MaxKeysPerRecord), nil)
+	case ErrGuestRecord:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgGuestRecordKey), nil)
+	default:
+		_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+	}
+	return err
+}
+
+// replyNicknameReserved tells until when deleted nickname is reserved
+func replyNicknameReserved(b *gotgbot.Bot, ctx *ext.Context, nickname string) error {
+	until := "?"
+	if t := reservedUntil(nickname); !t.IsZero() {
+		until = t.Format("2006-01-02 15:04")
+	}
+	_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgNicknameReserved, until), nil)
+	return err
 }
 
 func defaultHandler(b *gotgbot.Bot, ctx *ext.Context) error {
 	userID := ctx.EffectiveSender.Id()
 
-	// Online
-	if cfg.AdminID == userID && strings.HasPrefix(ctx.EffectiveMessage.Text, "/online") {
-		// Delete old
-		if cfg.OnlineMessageID != 0 {
-			bot.DeleteMessage(cfg.OnlineMessageChatID, cfg.OnlineMessageID, nil)
-		}
-		// Make new message
-		sent, err := ctx.EffectiveMessage.Reply(b, ".", nil)
-		if err != nil {
-			return err
-		}
-		// Persistent
-		cfg.OnlineMessageID = sent.MessageId
-		cfg.OnlineMessageChatID = sent.Chat.Id
-		SaveConfig(cfg)
-
-		updateOnlineMessage()
-		return nil
+	// Status board
+	if args, IsOnlineCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/online"); IsOnlineCommand && isAdmin(userID) {
+		return handleOnlineCommand(b, ctx, args)
 	}
 
 	// Allow only direct chat, no groups (Except /online)
@@ -110,36 +347,87 @@ func defaultHandler(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 
-	// Is registered?
-	if !allowedIDs.Contains(userID) {
-		ctx.EffectiveMessage.Forward(b, cfg.AdminID, nil)
-		msg := Msg(MsgAdminAckApprove, userID)
-		b.SendMessage(cfg.AdminID, msg, nil)
-		ctx.EffectiveMessage.Reply(b, Msg(MsgRequestSentToAdmin), nil)
-		return nil
+	tgname := strings.TrimSpace(ctx.EffectiveUser.Username + " " + ctx.EffectiveUser.FirstName + " " + ctx.EffectiveUser.LastName)
+	user := Sender{ID: userID, Name: tgname, LangCode: ctx.EffectiveUser.LanguageCode, Frontend: tgFrontend{}}
+
+	// Invite deep link
+	if code, IsStartCommand := strings.CutPrefix(ctx.EffectiveMessage.Text, "/start "); IsStartCommand {
+		err := RedeemInvite(user, strings.TrimSpace(code))
+		switch err {
+		case nil:
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgInviteAccepted), nil)
+		case ErrAlreadyApproved:
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgAlreadyApproved), nil)
+		case ErrBadInvite:
+			if allowRequest(userID) {
+				_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgBadInvite), nil)
+			} else {
+				err = nil
+			}
+		case ErrUserDenied, ErrUserBlocked:
+			err = nil
+		}
+		return err
+	}
+
+	// Is registered? Unapproved users are answered and looked up in chats only once in a while
+	if !Authorize(user) {
+		if !allowRequest(userID) {
+			return nil
+		}
+		if !approveChatMember(b, user) {
+			err := queueApproval(user, ctx.EffectiveMessage.Text)
+			if err == ErrUserDenied || err == ErrUserBlocked {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgRequestSentToAdmin), nil)
+			return err
+		}
 	}
 
-	if cfg.AdminID == userID {
+	if user.IsModerator() {
+		// Approval queue
+		if ctx.EffectiveMessage.Text == "/pending" {
+			pending := tgUsers.Pending()
+			if len(pending) == 0 {
+				_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgNoPendingRequests), nil)
+				return err
+			}
+			for _, u := range pending {
+				if err := (tgFrontend{}).AskApproval(userID, u, ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		// Live game sessions
+		if ctx.EffectiveMessage.Text == "/sessions" {
+			return handleSessions(b, ctx, user)
+		}
+		if nickname, IsKickCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/kick"); IsKickCommand {
+			return handleKick(b, ctx, user, nickname)
+		}
+
 		// Append
-		newIDstr, IsAppendCommand := strings.CutPrefix(ctx.EffectiveMessage.Text, "/a")
-		if IsAppendCommand {
-			newID, err := strconv.ParseInt(newIDstr, 10, 64)
+		if match := approveCommandRe.FindStringSubmatch(ctx.EffectiveMessage.Text); match != nil {
+			newID, err := strconv.ParseInt(match[1], 10, 64)
 			if err != nil {
 				_, err = ctx.EffectiveMessage.Reply(b, "Bad ID "+err.Error(), nil)
 				return err
 			}
 
-			if !allowedIDs.Add(newID) {
+			err = ApproveUser(user, newID)
+			if err == ErrAlreadyApproved {
 				_, err = ctx.EffectiveMessage.Reply(b, "User already registered", nil)
 				return err
 			}
-
-			log.Println("New user allowed: ", ctx.EffectiveSender.Name())
-			_, err = b.SendMessage(newID, Msg(MsgApproved), nil)
 			if err != nil {
 				msg := Msg(MsgCantApprove) + "\n" + err.Error()
 				_, err = ctx.EffectiveMessage.Reply(b, msg, nil)
-				allowedIDs.Remove(newID)
 				return err
 			}
 			_, err = ctx.EffectiveMessage.SetReaction(b, &gotgbot.SetMessageReactionOpts{
@@ -149,22 +437,79 @@ func defaultHandler(b *gotgbot.Bot, ctx *ext.Context) error {
 		}
 	}
 
+	if user.IsAdmin() {
+		// Search records
+		if query, IsFindCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/find"); IsFindCommand {
+			return handleFind(b, ctx, user, query)
+		}
+
+		// Give nickname to another user
+		if args, IsTransferCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/transfer"); IsTransferCommand {
+			return handleTransfer(b, ctx, user, args)
+		}
+
+		if args, IsMaintenanceCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/maintenance"); IsMaintenanceCommand {
+			return handleMaintenanceCommand(b, ctx, user, args)
+		}
+	}
+
 	if ctx.EffectiveMessage.Text == "/online" {
 		_, err := ctx.EffectiveMessage.Reply(b, "Admin-only command", nil)
 		return err
 	}
 
+	if ctx.EffectiveMessage.Text == "/start" {
+		_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgAlreadyApproved), nil)
+		return err
+	}
+
+	// Invite
+	if args, IsInviteCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/invite"); IsInviteCommand {
+		uses, _ := strconv.Atoi(strings.TrimSpace(args))
+		inv, err := CreateInvite(user, uses)
+		if err == ErrInviteQuota {
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgInviteQuota, cfg.InviteQuota), nil)
+			return err
+		}
+		if err != nil {
+			_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+			return err
+		}
+		link := fmt.Sprintf("https://t.me/%s?start=%s", b.Username, inv.Code)
+		msg := Msg(MsgInviteCreated, link, inv.MaxUses, inv.ExpiresAt.Format("2006-01-02 15:04"))
+		_, err = ctx.EffectiveMessage.Reply(b, msg, nil)
+		return err
+	}
+
 	// List
 	if ctx.EffectiveMessage.Text == "/list" {
 		msg := ""
-		records, err := storage.FindByTgID(userID)
+		records, err := ListNicknames(user)
 		if err != nil {
 			_, err = ctx.EffectiveMessage.Reply(b, "Error, report admin pls. "+err.Error(), nil)
 			return err
 		}
+		// Only token hashes are stored, so addresses are shown by hint
 		for _, record := range records {
-			msg += fmt.Sprintf("`%s.%s`  %s\n", record.Token, cfg.BaseDomain, record.Nickname)
+			msg += fmt.Sprintf("*%s*\n", escapeMarkdown(record.Nickname))
+			for _, key := range record.Keys {
+				msg += fmt.Sprintf("`%s….%s`  %s", key.Hint, cfg.BaseDomain, escapeMarkdown(key.Label))
+				if !key.CreatedAt.IsZero() {
+					msg += ", " + key.CreatedAt.Format(time.DateOnly)
+				}
+				if key.IsGuest() {
+					msg += " (" + describeGuestPass(&key) + ")"
+				}
+				nickKey := fmt.Sprintf("%s\\_%d", escapeMarkdown(record.Nickname), key.ID)
+				msg += "  /regen\\_" + nickKey
+				if len(record.Keys) > 1 {
+					msg += "  /revoke\\_" + nickKey
+				}
+				msg += "\n"
+			}
+			msg += "\n"
 		}
+		msg += Msg(MsgAddressesHidden) + "\n\n" + Msg(MsgKeysTip)
 		// Zero list?
 		if len(records) == 0 {
 			msg = Msg(MsgEmptyNicknameList)
@@ -173,16 +518,101 @@ func defaultHandler(b *gotgbot.Bot, ctx *ext.Context) error {
 		return err
 	}
 
+	// New access key
+	if args, IsAddKeyCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/addkey"); IsAddKeyCommand {
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgAddKeyUsage), nil)
+			return err
+		}
+		record, key, err := storage.AddKey(fields[0], userID, fields[1])
+		if err != nil {
+			return replyKeyError(b, ctx, err)
+		}
+		log.Printf("User %s added key `%s` for nickname: %s\n", record.TgName, key.Label, record.Nickname)
+		address := key.Token + "." + cfg.BaseDomain
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgKeyAdded, escapeMarkdown(key.Label), escapeMarkdown(record.Nickname), address), &gotgbot.SendMessageOpts{ParseMode: "Markdown"})
+		return err
+	}
+
+	// Guest pass
+	if args, IsGuestCommand := cutCommand(b, ctx.EffectiveMessage.Text, "/guest"); IsGuestCommand {
+		fields := strings.Fields(args)
+		if len(fields) < 1 {
+			_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgGuestUsage, cfg.GuestMaxDuration), nil)
+			return err
+		}
+		if !isValidMinecraftUsername(fields[0]) {
+			_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgBadNickame), nil)
+			return err
+		}
+		pass, err := parseGuestPass(fields[1:])
+		if err != nil {
+			_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgGuestUsage, cfg.GuestMaxDuration), nil)
+			return err
+		}
+
+		isAdmin := user.IsAdmin()
+		if pass.Duration == 0 && (pass.MaxUses == 0 || !isAdmin) {
+			pass.Duration = cfg.GuestMaxDuration
+		}
+		if !isAdmin {
+			pass.Duration = min(pass.Duration, cfg.GuestMaxDuration)
+			if countGuestPasses(userID) >= cfg.GuestQuota {
+				_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgGuestQuota, cfg.GuestQuota), nil)
+				return err
+			}
+		}
+
+		record, key, err := storage.IssueGuestPass(fields[0], tgname, userID, pass, isAdmin)
+		if err == ErrAccessDenied {
+			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgNicknameBusy), nil)
+			return err
+		}
+		if err == ErrNicknameReserved {
+			return replyNicknameReserved(b, ctx, fields[0])
+		}
+		if err != nil {
+			return replyKeyError(b, ctx, err)
+		}
+
+		msg := fmt.Sprintf("User `%s` issued guest pass for nickname %s: %s\n", tgname, record.Nickname, describeGuestPass(key))
+		log.Print(msg)
+		if !isAdmin {
+			notify(EventNicknames, msg)
+		}
+		address := key.Token + "." + cfg.BaseDomain
+		msg = Msg(MsgGuestIssued, escapeMarkdown(record.Nickname), address, describeGuestPass(key))
+		_, err = ctx.EffectiveMessage.Reply(b, msg, &gotgbot.SendMessageOpts{ParseMode: "Markdown"})
+		return err
+	}
+
+	// Revoke access key
+	if arg, IsRevokeCommand := strings.CutPrefix(ctx.EffectiveMessage.Text, "/revoke_"); IsRevokeCommand {
+		nickname, keyID := parseNickKey(arg)
+		err := storage.RevokeKey(nickname, userID, keyID)
+		if err != nil {
+			return replyKeyError(b, ctx, err)
+		}
+		log.Printf("User %d revoked key %d of nickname: %s\n", userID, keyID, nickname)
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgKeyRevoked), nil)
+		return err
+	}
+
 	// Delete list
 	if ctx.EffectiveMessage.Text == "/delete" {
-		msg := Msg(MsgSelectNickToDelete) + "\n"
-		records, err := storage.FindByTgID(userID)
+		note := Msg(MsgDeleteFreesNickname)
+		if cfg.NicknameCooldown > 0 {
+			note = Msg(MsgDeleteReservesNickname, formatDuration(cfg.NicknameCooldown))
+		}
+		msg := Msg(MsgSelectNickToDelete, note) + "\n"
+		records, err := ListNicknames(user)
 		if err != nil {
 			_, err = ctx.EffectiveMessage.Reply(b, "Error, report admin pls. "+err.Error(), nil)
 			return err
 		}
 		for _, record := range records {
-			msg += fmt.Sprintf("/%s\n", record.Nickname)
+			msg += fmt.Sprintf("/%s\n", escapeMarkdown(record.Nickname))
 		}
 		// Zero list?
 		if len(records) == 0 {
@@ -192,10 +622,44 @@ func defaultHandler(b *gotgbot.Bot, ctx *ext.Context) error {
 		return err
 	}
 
+	// Regenerate list
+	if ctx.EffectiveMessage.Text == "/regen" {
+		msg := Msg(MsgSelectNickToRegen) + "\n"
+		records, err := ListNicknames(user)
+		if err != nil {
+			_, err = ctx.EffectiveMessage.Reply(b, "Error, report admin pls. "+err.Error(), nil)
+			return err
+		}
+		for _, record := range records {
+			for _, key := range record.Keys {
+				msg += fmt.Sprintf("/regen\\_%s\\_%d  (%s)\n", escapeMarkdown(record.Nickname), key.ID, escapeMarkdown(key.Label))
+			}
+		}
+		// Zero list?
+		if len(records) == 0 {
+			msg = Msg(MsgEmptyNicknameList)
+		}
+		_, err = ctx.EffectiveMessage.Reply(b, msg, &gotgbot.SendMessageOpts{ParseMode: "Markdown"})
+		return err
+	}
+
+	// Regenerate token
+	if arg, IsRegenCommand := strings.CutPrefix(ctx.EffectiveMessage.Text, "/regen_"); IsRegenCommand {
+		nickname, keyID := parseNickKey(arg)
+		record, key, err := storage.RotateToken(nickname, userID, keyID)
+		if err != nil {
+			return replyKeyError(b, ctx, err)
+		}
+		log.Printf("User %s regenerated key `%s` for nickname: %s\n", record.TgName, key.Label, record.Nickname)
+		address := key.Token + "." + cfg.BaseDomain
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgTokenRegenerated, escapeMarkdown(record.Nickname), address), &gotgbot.SendMessageOpts{ParseMode: "Markdown"})
+		return err
+	}
+
 	// Delete nickname
 	nickToDelete, IsDeleteCommand := strings.CutPrefix(ctx.EffectiveMessage.Text, "/")
 	if IsDeleteCommand {
-		err := storage.DeleteByNickname(nickToDelete, userID)
+		until, err := DeleteNickname(user, nickToDelete)
 		if err == ErrAccessDenied || err == ErrNicknameNotFound {
 			_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgDeleteError), nil)
 			return err
@@ -204,40 +668,34 @@ func defaultHandler(b *gotgbot.Bot, ctx *ext.Context) error {
 			_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
 			return err
 		}
-		msg := fmt.Sprintf("User `%s` deleted nickname: %s\n", ctx.EffectiveUser.Username, nickToDelete)
-		log.Print(msg)
-		b.SendMessage(cfg.AdminID, msg, nil)
-		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgNicknameDeleted), nil)
+		msg := Msg(MsgNicknameDeleted)
+		if !until.IsZero() {
+			msg += "\n" + Msg(MsgReservedUntil, until.Format("2006-01-02 15:04"))
+		}
+		_, err = ctx.EffectiveMessage.Reply(b, msg, nil)
 		return err
 	}
 
 	// New minecraft username
 	mcUsername := ctx.EffectiveMessage.Text
-	if !isValidMinecraftUsername(mcUsername) {
-		_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgBadNickame), nil)
+	newUserInfo, err := RegisterNickname(user, mcUsername)
+	switch err {
+	case nil:
+	case ErrBadNickname:
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgBadNickame), nil)
 		return err
-	}
-
-	tgname := ctx.EffectiveUser.Username + " " + ctx.EffectiveUser.FirstName + " " + ctx.EffectiveUser.LastName
-	newUserInfo, err := storage.AddRecord(mcUsername, tgname, userID)
-	if err == ErrNicknameExists {
+	case ErrNicknameExists:
 		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgNicknameBusy), nil)
 		return err
-	}
-	if err != nil {
+	case ErrNicknameReserved:
+		return replyNicknameReserved(b, ctx, mcUsername)
+	default:
 		_, err = ctx.EffectiveMessage.Reply(b, err.Error(), nil)
-		b.SendMessage(cfg.AdminID, err.Error(), nil)
-		log.Printf("!!!!!!!!!!!!!!!!!!!\n %s", err.Error())
 		return err
 	}
 
-	// Notify admin
-	msg := fmt.Sprintf("User `%s` registered nickname: %s\n", newUserInfo.TgName, newUserInfo.Nickname)
-	log.Print(msg)
-	b.SendMessage(cfg.AdminID, msg, nil)
-
-	address := newUserInfo.Token + "." + cfg.BaseDomain
-	msg = Msg(MsgRegistrationSuccess, address, cfg.SupportName)
+	address := newUserInfo.Keys[0].Token + "." + cfg.BaseDomain
+	msg := Msg(MsgRegistrationSuccess, address, cfg.SupportName)
 	_, err = ctx.EffectiveMessage.Reply(b, msg, &gotgbot.SendMessageOpts{ParseMode: "Markdown"})
 	b.SendMessage(userID, Msg(MsgRegistrationTip), nil)
 	return err
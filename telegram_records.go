@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// Admin record management: `/find` with paginated results, buttons to
+// suspend and delete records, `/transfer` to give nickname to another user
+
+const (
+	FindPageSize = 5
+	// Query is kept in callback data, which is limited to 64 bytes
+	maxFindQueryLen = 40
+)
+
+// findPage renders one page of search results with action buttons.
+// The refresh button keeps query and page for later updates of the message
+func findPage(admin Sender, query string, page int) (string, *gotgbot.InlineKeyboardMarkup, error) {
+	records, err := SearchRecords(admin, query)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(records) == 0 {
+		return Msg(MsgNothingFound), nil, nil
+	}
+
+	total := len(records)
+	pages := (total + FindPageSize - 1) / FindPageSize
+	page = max(0, min(page, pages-1))
+	records = records[page*FindPageSize : min(total, (page+1)*FindPageSize)]
+
+	msg := Msg(MsgFindHeader, total, page+1, pages) + "\n\n"
+	keyboard := [][]gotgbot.InlineKeyboardButton{}
+	for _, r := range records {
+		flags := ""
+		if r.Disabled {
+			flags += " ⏸"
+		}
+		if r.Guest {
+			flags += " 🎫"
+		}
+		msg += Msg(MsgFindRecord, escapeMarkdown(r.Nickname), flags, escapeMarkdown(r.TgName), r.ID,
+			formatCLITime(r.CreatedAt), formatCLITime(r.LastSeen), len(r.Keys)) + "\n\n"
+
+		suspend := gotgbot.InlineKeyboardButton{Text: "⏸ " + r.Nickname, CallbackData: "rec:suspend:" + r.Nickname}
+		if r.Disabled {
+			suspend = gotgbot.InlineKeyboardButton{Text: "▶️ " + r.Nickname, CallbackData: "rec:enable:" + r.Nickname}
+		}
+		keyboard = append(keyboard, []gotgbot.InlineKeyboardButton{
+			suspend,
+			{Text: "🗑 " + r.Nickname, CallbackData: "rec:delete:" + r.Nickname},
+		})
+	}
+	msg += Msg(MsgFindTip)
+
+	nav := []gotgbot.InlineKeyboardButton{}
+	if page > 0 {
+		nav = append(nav, gotgbot.InlineKeyboardButton{Text: "◀️", CallbackData: fmt.Sprintf("find:%d:%s", page-1, query)})
+	}
+	nav = append(nav, gotgbot.InlineKeyboardButton{
+		Text:         fmt.Sprintf("🔄 %d/%d", page+1, pages),
+		CallbackData: fmt.Sprintf("find:%d:%s", page, query),
+	})
+	if page < pages-1 {
+		nav = append(nav, gotgbot.InlineKeyboardButton{Text: "▶️", CallbackData: fmt.Sprintf("find:%d:%s", page+1, query)})
+	}
+	keyboard = append(keyboard, nav)
+	return msg, &gotgbot.InlineKeyboardMarkup{InlineKeyboard: keyboard}, nil
+}
+
+// handleFind replies to `/find [query]`
+func handleFind(b *gotgbot.Bot, ctx *ext.Context, admin Sender, query string) error {
+	query = strings.TrimSpace(query)
+	if query == "help" {
+		_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgFindUsage), nil)
+		return err
+	}
+	if len(query) > maxFindQueryLen {
+		query = strings.ToValidUTF8(query[:maxFindQueryLen], "")
+	}
+
+	msg, keyboard, err := findPage(admin, query, 0)
+	if err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+		return err
+	}
+	opts := &gotgbot.SendMessageOpts{ParseMode: "Markdown"}
+	if keyboard != nil {
+		opts.ReplyMarkup = *keyboard
+	}
+	_, err = ctx.EffectiveMessage.Reply(b, msg, opts)
+	return err
+}
+
+// handleTransfer replies to `/transfer <nickname> <Telegram ID>`
+func handleTransfer(b *gotgbot.Bot, ctx *ext.Context, admin Sender, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgTransferUsage), nil)
+		return err
+	}
+	newOwner, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgTransferUsage), nil)
+		return err
+	}
+
+	record, err := TransferNickname(admin, fields[0], newOwner)
+	if err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+		return err
+	}
+	address := record.Keys[0].Token + "." + cfg.BaseDomain
+	if _, err := b.SendMessage(newOwner, Msg(MsgNicknameTransferred, record.Nickname, address), nil); err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgTransferUndelivered, record.Nickname, address), nil)
+		return err
+	}
+	_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgTransferDone, record.Nickname), nil)
+	return err
+}
+
+// findCallback shows another page of search results, `find:<page>:<query>`
+func findCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	cq := ctx.CallbackQuery
+	admin := Sender{ID: cq.From.Id, Name: cq.From.Username, Frontend: tgFrontend{}}
+	pageStr, query, _ := strings.Cut(strings.TrimPrefix(cq.Data, "find:"), ":")
+	page, _ := strconv.Atoi(pageStr)
+
+	if err := refreshFindPage(b, cq, admin, query, page); err != nil {
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: err.Error(), ShowAlert: true})
+		return err
+	}
+	_, err := cq.Answer(b, nil)
+	return err
+}
+
+// refreshFindPage renders page again in the message with the pressed button
+func refreshFindPage(b *gotgbot.Bot, cq *gotgbot.CallbackQuery, admin Sender, query string, page int) error {
+	msg, ok := cq.Message.(gotgbot.Message)
+	if !ok {
+		return nil
+	}
+	text, keyboard, err := findPage(admin, query, page)
+	if err != nil {
+		return err
+	}
+	opts := &gotgbot.EditMessageTextOpts{ParseMode: "Markdown"}
+	if keyboard != nil {
+		opts.ReplyMarkup = *keyboard
+	}
+	_, _, err = msg.EditText(b, text, opts)
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+// findPageOf returns query and page kept in refresh button of search results message
+func findPageOf(msg gotgbot.Message) (string, int, bool) {
+	if msg.ReplyMarkup == nil {
+		return "", 0, false
+	}
+	for _, row := range msg.ReplyMarkup.InlineKeyboard {
+		for _, button := range row {
+			data, isFind := strings.CutPrefix(button.CallbackData, "find:")
+			if isFind && strings.HasPrefix(button.Text, "🔄") {
+				pageStr, query, _ := strings.Cut(data, ":")
+				page, _ := strconv.Atoi(pageStr)
+				return query, page, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// recordCallback handles record buttons, `rec:<action>:<nickname>`
+func recordCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	cq := ctx.CallbackQuery
+	admin := Sender{ID: cq.From.Id, Name: cq.From.Username, Frontend: tgFrontend{}}
+	action, nickname, _ := strings.Cut(strings.TrimPrefix(cq.Data, "rec:"), ":")
+
+	var err error
+	switch action {
+	case "suspend", "enable":
+		err = SuspendNickname(admin, nickname, action == "suspend")
+		if msg, ok := cq.Message.(gotgbot.Message); ok && err == nil {
+			if query, page, ok := findPageOf(msg); ok {
+				err = refreshFindPage(b, cq, admin, query, page)
+			}
+		}
+	case "delete":
+		// Ask again in a separate message, search results stay as they are
+		var record *StorageRecord
+		if !admin.IsAdmin() {
+			err = ErrAdminOnly
+		} else if record, err = storage.FindByNickname(nickname); err == nil {
+			_, err = b.SendMessage(cq.From.Id, Msg(MsgConfirmDelete, record.Nickname, record.TgName, record.ID), &gotgbot.SendMessageOpts{
+				ReplyMarkup: gotgbot.InlineKeyboardMarkup{
+					InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+						{Text: Msg(MsgConfirmDeleteButton), CallbackData: "rec:confirm:" + record.Nickname},
+					}},
+				},
+			})
+		}
+	case "confirm":
+		err = ForceDeleteNickname(admin, nickname)
+		if msg, ok := cq.Message.(gotgbot.Message); ok && err == nil {
+			msg.EditText(b, msg.Text+"\n\n"+Msg(MsgRecordDeleted), nil)
+		}
+	default:
+		err = fmt.Errorf("unknown action `%s`", action)
+	}
+	if err != nil {
+		_, err = cq.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: err.Error(), ShowAlert: true})
+		return err
+	}
+	_, err = cq.Answer(b, nil)
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// handleSessions replies to `/sessions` with live game sessions
+func handleSessions(b *gotgbot.Bot, ctx *ext.Context, moderator Sender) error {
+	list, err := ListSessions(moderator)
+	if err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+		return err
+	}
+	if len(list) == 0 {
+		_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgNoSessions), nil)
+		return err
+	}
+
+	msg := Msg(MsgSessionsHeader, len(list)) + "\n\n"
+	for _, s := range list {
+		msg += Msg(MsgSession, escapeMarkdown(s.Nickname), escapeMarkdown(s.OwnerName), s.OwnerID, escapeMarkdown(s.KeyLabel),
+			s.ClientIP, s.Protocol, formatDuration(time.Since(s.StartedAt)), formatBytes(s.BytesIn), formatBytes(s.BytesOut)) + "\n\n"
+	}
+	_, err = ctx.EffectiveMessage.Reply(b, msg, &gotgbot.SendMessageOpts{ParseMode: "Markdown"})
+	return err
+}
+
+// handleKick replies to `/kick <nickname>`
+func handleKick(b *gotgbot.Bot, ctx *ext.Context, moderator Sender, nickname string) error {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" || strings.ContainsAny(nickname, " \n") {
+		_, err := ctx.EffectiveMessage.Reply(b, Msg(MsgKickUsage), nil)
+		return err
+	}
+
+	kicked, err := KickPlayer(moderator, nickname)
+	if err != nil {
+		_, err = ctx.EffectiveMessage.Reply(b, "Error. "+err.Error(), nil)
+		return err
+	}
+	_, err = ctx.EffectiveMessage.Reply(b, Msg(MsgKicked, nickname, kicked), nil)
+	return err
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUsersFile = "users.json"
+	// Denied users may ask for approval again after this time
+	DeniedRequestCooldown = time.Hour * 24 * 7
+)
+
+// Status of not approved user
+const (
+	UserPending = "pending"
+	UserDenied  = "denied"
+	UserBlocked = "blocked"
+)
+
+// TgUser is a telegram account known to the bot
+type TgUser struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	LangCode    string    `json:"lang"`
+	Approved    bool      `json:"approved"`
+	ApprovedBy  int64     `json:"approved_by"` // 0 if approved automatically
+	ApprovedAt  time.Time `json:"approved_at"`
+	Status      string    `json:"status,omitempty"` // Pending, denied or blocked, empty once approved
+	RequestedAt time.Time `json:"requested_at,omitempty"`
+	DecidedBy   int64     `json:"decided_by,omitempty"` // Who denied or blocked
+	DecidedAt   time.Time `json:"decided_at,omitempty"`
+	InvitedBy   int64     `json:"invited_by,omitempty"` // Author of invite the user joined with
+	ViaChat     int64     `json:"via_chat,omitempty"`   // Approved as member of this chat
+	Suspended   []string  `json:"suspended,omitempty"`  // Nicknames disabled after leaving the chat
+}
+
+// UserStore is a persisted table of telegram users, kept in memory
+// and saved as a whole JSON file on every change
+type UserStore struct {
+	filename string
+	mu       sync.RWMutex
+	users    map[int64]*TgUser
+}
+
+// NewUserStore loads users table from file. created is true if the file didn't exist
+func NewUserStore(filename string) (store *UserStore, created bool, err error) {
+	store = &UserStore{
+		filename: filename,
+		users:    make(map[int64]*TgUser),
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var list []*TgUser
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, false, err
+	}
+	for _, u := range list {
+		store.users[u.ID] = u
+	}
+	return store, false, nil
+}
+
+// Get returns a copy of user info
+func (s *UserStore) Get(id int64) (TgUser, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return TgUser{}, false
+	}
+	return *u, true
+}
+
+// IsApproved reports whether user is allowed to use the bot
+func (s *UserStore) IsApproved(id int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	return ok && u.Approved
+}
+
+// Approve marks user as approved by `by`. Returns false if already approved
+func (s *UserStore) Approve(id, by int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, _ := s.copyOf(id, "", "")
+	if u.Approved {
+		return false, nil
+	}
+	u.Approved = true
+	u.ApprovedBy = by
+	u.ApprovedAt = time.Now()
+	u.Status = ""
+	if err := s.put(u); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApproveInvited approves user who joined with invite of inviter.
+// Returns false if already approved
+func (s *UserStore) ApproveInvited(id, inviter int64, name, langCode string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, _ := s.copyOf(id, name, langCode)
+	if u.Approved {
+		return false, nil
+	}
+	// Not approved until saved, so the invite use can be given back
+	u.Approved = true
+	u.ApprovedBy = inviter
+	u.ApprovedAt = time.Now()
+	u.InvitedBy = inviter
+	u.Status = ""
+	if err := s.put(u); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ApproveMember approves user as member of chat. Returns nicknames
+// suspended when the user left the chat earlier, they are forgotten
+func (s *UserStore) ApproveMember(id, chatID int64, name, langCode string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, _ := s.copyOf(id, name, langCode)
+	suspended := u.Suspended
+	u.Approved = true
+	u.ApprovedBy = 0
+	u.ApprovedAt = time.Now()
+	u.ViaChat = chatID
+	u.Status = ""
+	u.Suspended = nil
+	if err := s.put(u); err != nil {
+		return nil, err
+	}
+	return suspended, nil
+}
+
+// Suspend takes back approval of user who left the chat, remembering disabled nicknames
+func (s *UserStore) Suspend(id int64, nicknames []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.copyOf(id, "", "")
+	if !ok {
+		return nil
+	}
+	u.Approved = false
+	u.Suspended = nicknames
+	return s.put(u)
+}
+
+// Members returns users approved as chat members, including suspended ones
+func (s *UserStore) Members() []TgUser {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []TgUser
+	for _, u := range s.users {
+		if u.ViaChat != 0 {
+			result = append(result, *u)
+		}
+	}
+	return result
+}
+
+// Request puts user into pending queue. Returns false if user is already
+// waiting, approved, blocked or was denied recently
+func (s *UserStore) Request(id int64, name, langCode string) (TgUser, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, _ := s.copyOf(id, name, langCode)
+	switch {
+	case u.Approved, u.Status == UserPending, u.Status == UserBlocked:
+		return u, false, nil
+	case u.Status == UserDenied && time.Since(u.DecidedAt) < DeniedRequestCooldown:
+		return u, false, nil
+	}
+	u.Status = UserPending
+	u.RequestedAt = time.Now()
+	if err := s.put(u); err != nil {
+		return u, false, err
+	}
+	return u, true, nil
+}
+
+// Decide denies or blocks user, taking back approval
+func (s *UserStore) Decide(id, by int64, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, _ := s.copyOf(id, "", "")
+	u.Approved = false
+	u.ApprovedBy = 0
+	u.ApprovedAt = time.Time{}
+	u.Status = status
+	u.DecidedBy = by
+	u.DecidedAt = time.Now()
+	return s.put(u)
+}
+
+// Pending returns users waiting for approval, oldest request first
+func (s *UserStore) Pending() []TgUser {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []TgUser
+	for _, u := range s.users {
+		if u.Status == UserPending {
+			result = append(result, *u)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].RequestedAt.Before(result[j].RequestedAt) })
+	return result
+}
+
+// ImportApproved adds already approved users with their names in one save
+func (s *UserStore) ImportApproved(names map[int64]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var added []int64
+	for id, name := range names {
+		if _, exists := s.users[id]; exists {
+			continue
+		}
+		s.users[id] = &TgUser{ID: id, Name: name, Approved: true, ApprovedAt: now}
+		added = append(added, id)
+	}
+	if err := s.save(); err != nil {
+		for _, id := range added {
+			delete(s.users, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// Revoke removes approval from user
+func (s *UserStore) Revoke(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.copyOf(id, "", "")
+	if !ok || !u.Approved {
+		return nil
+	}
+	u.Approved = false
+	u.ApprovedBy = 0
+	u.ApprovedAt = time.Time{}
+	return s.put(u)
+}
+
+// Touch refreshes name and language of already known user
+func (s *UserStore) Touch(id int64, name, langCode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.copyOf(id, "", "")
+	if !ok || (u.Name == name && u.LangCode == langCode) {
+		return nil
+	}
+	u.Name = name
+	u.LangCode = langCode
+	return s.put(u)
+}
+
+// copyOf returns a copy of user to change and put back, or a new user if
+// it's unknown. Caller must hold write lock
+func (s *UserStore) copyOf(id int64, name, langCode string) (TgUser, bool) {
+	if u, ok := s.users[id]; ok {
+		return *u, true
+	}
+	return TgUser{ID: id, Name: name, LangCode: langCode}, false
+}
+
+// put replaces user and saves the table. If saving fails the change is undone,
+// so memory doesn't differ from the file. Caller must hold write lock
+func (s *UserStore) put(u TgUser) error {
+	prev, existed := s.users[u.ID]
+	s.users[u.ID] = &u
+	if err := s.save(); err != nil {
+		if existed {
+			s.users[u.ID] = prev
+		} else {
+			delete(s.users, u.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// save writes the whole table to file. Caller must hold write lock
+func (s *UserStore) save() error {
+	list := make([]*TgUser, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return writeFileAtomic(s.filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	})
+}